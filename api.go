@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// apiClient is a client in the JSON API
+type apiClient struct {
+	Name    string    `json:"name"`
+	Address string    `json:"address"`
+	Up      bool      `json:"up"`
+	Error   string    `json:"error,omitempty"`
+	Updated time.Time `json:"updated"`
+	Slots   int       `json:"slots"`
+	Queues  int       `json:"queues"`
+}
+
+// apiSlot is a folding slot in the JSON API
+type apiSlot struct {
+	ID          string          `json:"id"`
+	Status      string          `json:"status"`
+	Description string          `json:"description"`
+	Reason      string          `json:"reason"`
+	Paused      bool            `json:"paused"`
+	Idle        bool            `json:"idle"`
+	Options     *apiSlotOptions `json:"options,omitempty"`
+}
+
+// apiSlotOptions is the slot configuration in the JSON API, numbers which cannot be parsed are null
+type apiSlotOptions struct {
+	Cause              string   `json:"cause"`
+	ClientType         string   `json:"client_type"`
+	ClientSubtype      string   `json:"client_subtype"`
+	CorePriority       string   `json:"core_priority"`
+	MaxPacketSize      string   `json:"max_packet_size"`
+	GPUIndex           *float64 `json:"gpu_index"`
+	CPUs               *float64 `json:"cpus"`
+	MaxUnits           *float64 `json:"max_units"`
+	NextUnitPercentage *float64 `json:"next_unit_percentage"`
+	CheckpointMinutes  *float64 `json:"checkpoint_minutes"`
+}
+
+// apiQueue is a work unit in the JSON API, values which cannot be parsed are null
+type apiQueue struct {
+	ID                   string     `json:"id"`
+	Slot                 string     `json:"slot"`
+	State                string     `json:"state"`
+	Error                string     `json:"error"`
+	Project              int        `json:"project"`
+	Run                  int        `json:"run"`
+	Clone                int        `json:"clone"`
+	Gen                  int        `json:"gen"`
+	Core                 string     `json:"core"`
+	Unit                 string     `json:"unit"`
+	PercentDone          *float64   `json:"percent_done"`
+	PPD                  *float64   `json:"ppd"`
+	CreditEstimate       *float64   `json:"credit_estimate"`
+	BaseCredit           *float64   `json:"base_credit"`
+	EtaSeconds           *float64   `json:"eta_seconds"`
+	TimeRemainingSeconds *float64   `json:"time_remaining_seconds"`
+	TpfSeconds           *float64   `json:"tpf_seconds"`
+	NextAttemptSeconds   *float64   `json:"next_attempt_seconds"`
+	WaitingOn            string     `json:"waiting_on"`
+	Attempts             int        `json:"attempts"`
+	TotalFrames          int        `json:"total_frames"`
+	FramesDone           int        `json:"frames_done"`
+	Assigned             *time.Time `json:"assigned"`
+	Timeout              *time.Time `json:"timeout"`
+	Deadline             *time.Time `json:"deadline"`
+	WS                   string     `json:"ws"`
+	CS                   string     `json:"cs"`
+}
+
+// apiOptions is the client configuration in the JSON API, the passkey is never exposed
+type apiOptions struct {
+	User       string `json:"user"`
+	Team       string `json:"team"`
+	Power      string `json:"power"`
+	Cause      string `json:"cause"`
+	PasskeySet bool   `json:"passkey_set"`
+}
+
+func parseNumber(s string) *float64 {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return nil
+	}
+	return &v
+}
+
+func parseSeconds(s string) *float64 {
+	d, err := parseFAHDuration(s)
+	if err != nil {
+		return nil
+	}
+	v := d.Seconds()
+	return &v
+}
+
+func parseTimestamp(s string) *time.Time {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return nil
+	}
+	return &t
+}
+
+func newAPIClient(c *Client, s Snapshot) apiClient {
+	a := apiClient{
+		Name:    c.Name,
+		Address: privacy.Apply(fieldAddress, c.Address),
+		Up:      s.Error == nil,
+		Updated: s.Time,
+		Slots:   len(s.Data.Slots),
+		Queues:  len(s.Data.Queues),
+	}
+	if s.Error != nil {
+		a.Error = privacy.Scrub(s.Error.Error())
+	}
+	return a
+}
+
+func newAPISlots(data Metrics) []apiSlot {
+	slots := make([]apiSlot, 0, len(data.Slots))
+	for _, s := range data.Slots {
+		a := apiSlot{
+			ID:          s.ID,
+			Status:      s.Status,
+			Description: s.Description,
+			Reason:      s.Reason,
+			Paused:      s.Options.Paused,
+			Idle:        s.Idle,
+		}
+		if o, ok := data.SlotOptions[s.ID]; ok {
+			a.Options = &apiSlotOptions{
+				Cause:              o.Cause,
+				ClientType:         o.ClientType,
+				ClientSubtype:      o.ClientSubtype,
+				CorePriority:       o.CorePriority,
+				MaxPacketSize:      o.MaxPacketSize,
+				GPUIndex:           parseNumber(o.GPUIndex),
+				CPUs:               parseNumber(o.CPUs),
+				MaxUnits:           parseNumber(o.MaxUnits),
+				NextUnitPercentage: parseNumber(o.NextUnitPercentage),
+				CheckpointMinutes:  parseNumber(o.Checkpoint),
+			}
+		}
+		slots = append(slots, a)
+	}
+	return slots
+}
+
+func newAPIQueues(data Metrics) []apiQueue {
+	queues := make([]apiQueue, 0, len(data.Queues))
+	for _, q := range data.Queues {
+		queues = append(queues, apiQueue{
+			ID:                   q.ID,
+			Slot:                 q.Slot,
+			State:                q.State,
+			Error:                q.Error,
+			Project:              q.Project,
+			Run:                  q.Run,
+			Clone:                q.Clone,
+			Gen:                  q.Gen,
+			Core:                 q.Core,
+			Unit:                 q.Unit,
+			PercentDone:          parseNumber(q.PercentDone),
+			PPD:                  parseNumber(q.Ppd),
+			CreditEstimate:       parseNumber(q.CreditEstimate),
+			BaseCredit:           parseNumber(q.BaseCredit),
+			EtaSeconds:           parseSeconds(q.Eta),
+			TimeRemainingSeconds: parseSeconds(q.TimeRemaining),
+			TpfSeconds:           parseSeconds(q.Tpf),
+			NextAttemptSeconds:   parseSeconds(q.NextAttempt),
+			WaitingOn:            q.WaitingOn,
+			Attempts:             q.Attempts,
+			TotalFrames:          q.TotalFrames,
+			FramesDone:           q.FramesDone,
+			Assigned:             parseTimestamp(q.Assigned),
+			Timeout:              parseTimestamp(q.Timeout),
+			Deadline:             parseTimestamp(q.Deadline),
+			WS:                   q.Ws,
+			CS:                   q.Cs,
+		})
+	}
+	return queues
+}
+
+func newAPIOptions(o Options) apiOptions {
+	return apiOptions{
+		User:       o.User,
+		Team:       o.Team,
+		Power:      o.Power,
+		Cause:      o.Cause,
+		PasskeySet: o.Passkey != "",
+	}
+}
+
+// writeJSON writes v as the JSON response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Cannot write JSON response: %v", err)
+	}
+}
+
+// writeJSONError writes an error as the JSON response
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// clientsHandler serves /api/v1/clients and /api/v1/clients/{name}/{slots,queues,options,donor},
+// clients are only queried when their data is older than maxAge
+func clientsHandler(set *ClientSet, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/clients"), "/")
+		if path == "" {
+			clients := set.All()
+			list := make([]apiClient, 0, len(clients))
+			for _, c := range clients {
+				list = append(list, newAPIClient(c, c.Snapshot(maxAge)))
+			}
+			writeJSON(w, http.StatusOK, list)
+			return
+		}
+		parts := strings.Split(path, "/")
+		client := set.Get(parts[0])
+		if client == nil || len(parts) > 2 {
+			writeJSONError(w, http.StatusNotFound, "not found")
+			return
+		}
+		s := client.Snapshot(maxAge)
+		if len(parts) == 1 {
+			writeJSON(w, http.StatusOK, newAPIClient(client, s))
+			return
+		}
+		if s.Error != nil {
+			writeJSONError(w, http.StatusBadGateway, privacy.Scrub(s.Error.Error()))
+			return
+		}
+		switch parts[1] {
+		case "slots":
+			writeJSON(w, http.StatusOK, newAPISlots(s.Data))
+		case "queues":
+			writeJSON(w, http.StatusOK, newAPIQueues(s.Data))
+		case "options":
+			writeJSON(w, http.StatusOK, newAPIOptions(s.Data.Options))
+		case "donor":
+			if !getAPI {
+				writeJSONError(w, http.StatusNotFound, "donor API is disabled")
+				return
+			}
+			writeJSON(w, http.StatusOK, s.Data.Donor)
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Exit codes of the check command, following the Nagios plugin conventions
+const (
+	exitOK       = 0
+	exitCritical = 2
+	exitUnknown  = 3
+)
+
+// command is a CLI subcommand, which queries clients with run or generates a file with generate
+type command struct {
+	help     string
+	run      func(clients []*Client, output string) int
+	generate func(output string) int
+	// flags registers command specific flags
+	flags func(fs *flag.FlagSet)
+}
+
+var commands = map[string]command{
+	"status": {help: "Show a summary of each client", run: runStatus},
+	"queue":  {help: "Show the work units of each client", run: runQueue},
+	"slots":  {help: "Show the folding slots of each client", run: runSlots},
+	"info":   {help: "Show the client and system information", run: runInfo},
+	"check": {help: "Exit non-zero if any slot failed or any unit is stalled", run: runCheck, flags: func(fs *flag.FlagSet) {
+		fs.IntVar(&checkMaxAttempts, "check.max-attempts", 3, "Consider a unit stalled after this many failed attempts")
+	}},
+	"dashboard": {help: "Print a Grafana dashboard for the exported metrics", generate: runDashboard, flags: dashboardFlags},
+	"rules":     {help: "Print Prometheus recording and alerting rules for the exported metrics", generate: runRules, flags: rulesFlags},
+}
+
+var checkMaxAttempts int
+
+// stringList is a flag which can be repeated
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// printCommands lists the subcommands
+func printCommands(out io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(out, "Commands:")
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-10s %s\n", name, commands[name].help)
+	}
+}
+
+// runCommand runs a CLI subcommand and returns the exit code
+func runCommand(name string, args []string) int {
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
+		return exitUnknown
+	}
+	var (
+		addresses  stringList
+		configFile string
+		output     string
+	)
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Var(&addresses, "fah.address", "Listen address of FAH client, can be repeated (default "+defaultFahAddress+")")
+	fs.StringVar(&configFile, "config.file", "", "Path to configuration file, overrides -fah.address")
+	fs.StringVar(&output, "output", "table", "Output format (table, json)")
+	if cmd.flags != nil {
+		cmd.flags(fs)
+	}
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of %s %s: %s\n", os.Args[0], name, cmd.help)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if output != "table" && output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", output)
+		return exitUnknown
+	}
+	if cmd.generate != nil {
+		return cmd.generate(output)
+	}
+
+	var clients []*Client
+	if configFile != "" {
+		cfg, err := loadConfig(configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot load config: %v\n", err)
+			return exitUnknown
+		}
+		for _, cc := range cfg.Clients {
+			clients = append(clients, NewClient(cc))
+		}
+	} else {
+		if len(addresses) == 0 {
+			addresses = append(addresses, defaultFahAddress)
+		}
+		for _, a := range addresses {
+			clients = append(clients, NewClient(ClientConfig{Name: a, Address: a}))
+		}
+	}
+	return cmd.run(clients, output)
+}
+
+// printOutput prints rows as a table, or v as JSON
+func printOutput(output string, v interface{}, header []string, rows [][]string) {
+	if output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(v)
+		return
+	}
+	printTable(os.Stdout, header, rows)
+}
+
+func printTable(out io.Writer, header []string, rows [][]string) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(w, strings.Join(row, "\t"))
+	}
+	w.Flush()
+}
+
+// clientStatus is the summary printed by the status command
+type clientStatus struct {
+	Client  string  `json:"client"`
+	Up      bool    `json:"up"`
+	Error   string  `json:"error,omitempty"`
+	User    string  `json:"user"`
+	Team    string  `json:"team"`
+	Slots   int     `json:"slots"`
+	Running int     `json:"running"`
+	PPD     float64 `json:"ppd"`
+}
+
+func runStatus(clients []*Client, output string) int {
+	var statuses []clientStatus
+	var rows [][]string
+	code := exitOK
+	for _, c := range clients {
+		s := clientStatus{Client: c.Name}
+		data, err := c.Collect()
+		if err != nil {
+			s.Error = err.Error()
+			code = exitUnknown
+		} else {
+			s.Up = true
+			s.User = data.Options.User
+			s.Team = data.Options.Team
+			s.Slots = len(data.Slots)
+			for _, q := range data.Queues {
+				if q.State == "RUNNING" {
+					s.Running++
+				}
+				ppd, _ := strconv.ParseFloat(q.Ppd, 64)
+				s.PPD += ppd
+			}
+		}
+		statuses = append(statuses, s)
+		rows = append(rows, []string{s.Client, strconv.FormatBool(s.Up), s.User, s.Team,
+			strconv.Itoa(s.Slots), strconv.Itoa(s.Running), strconv.FormatFloat(s.PPD, 'f', 0, 64), s.Error})
+	}
+	printOutput(output, statuses, []string{"CLIENT", "UP", "USER", "TEAM", "SLOTS", "RUNNING", "PPD", "ERROR"}, rows)
+	return code
+}
+
+// clientQueue is a work unit printed by the queue command
+type clientQueue struct {
+	Client string `json:"client"`
+	QueueInfo
+}
+
+func runQueue(clients []*Client, output string) int {
+	var queues []clientQueue
+	var rows [][]string
+	code := exitOK
+	for _, c := range clients {
+		var data []QueueInfo
+		if err := c.Read("queue-info", &data); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read queue info from %s: %v\n", c.Name, err)
+			code = exitUnknown
+			continue
+		}
+		for _, q := range data {
+			queues = append(queues, clientQueue{Client: c.Name, QueueInfo: q})
+			rows = append(rows, []string{c.Name, q.Slot, q.ID, q.State,
+				fmt.Sprintf("%d (%d, %d, %d)", q.Project, q.Run, q.Clone, q.Gen),
+				q.PercentDone, q.Ppd, q.Eta, q.Error})
+		}
+	}
+	printOutput(output, queues, []string{"CLIENT", "SLOT", "QUEUE", "STATE", "PROJECT", "PROGRESS", "PPD", "ETA", "ERROR"}, rows)
+	return code
+}
+
+// clientSlot is a folding slot printed by the slots command
+type clientSlot struct {
+	Client string `json:"client"`
+	SlotInfo
+}
+
+func runSlots(clients []*Client, output string) int {
+	var slots []clientSlot
+	var rows [][]string
+	code := exitOK
+	for _, c := range clients {
+		var data []SlotInfo
+		if err := c.Read("slot-info", &data); err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read slot info from %s: %v\n", c.Name, err)
+			code = exitUnknown
+			continue
+		}
+		for _, s := range data {
+			slots = append(slots, clientSlot{Client: c.Name, SlotInfo: s})
+			rows = append(rows, []string{c.Name, s.ID, s.Status, s.Description,
+				strconv.FormatBool(s.Options.Paused), strconv.FormatBool(s.Idle), s.Reason})
+		}
+	}
+	printOutput(output, slots, []string{"CLIENT", "SLOT", "STATUS", "DESCRIPTION", "PAUSED", "IDLE", "REASON"}, rows)
+	return code
+}
+
+func runInfo(clients []*Client, output string) int {
+	infos := make(map[string][]InfoSection)
+	var rows [][]string
+	code := exitOK
+	for _, c := range clients {
+		sections, err := c.Info()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Cannot read info from %s: %v\n", c.Name, err)
+			code = exitUnknown
+			continue
+		}
+		infos[c.Name] = sections
+		for _, s := range sections {
+			for _, kv := range s.Values {
+				rows = append(rows, []string{c.Name, s.Name, kv[0], kv[1]})
+			}
+		}
+	}
+	printOutput(output, infos, []string{"CLIENT", "SECTION", "KEY", "VALUE"}, rows)
+	return code
+}
+
+// checkResult is a problem found by the check command
+type checkResult struct {
+	Client  string `json:"client"`
+	Slot    string `json:"slot,omitempty"`
+	Queue   string `json:"queue,omitempty"`
+	Problem string `json:"problem"`
+}
+
+func runCheck(clients []*Client, output string) int {
+	results := []checkResult{}
+	code := exitOK
+	now := time.Now()
+	for _, c := range clients {
+		data, err := c.Collect()
+		if err != nil {
+			results = append(results, checkResult{Client: c.Name, Problem: "unreachable: " + err.Error()})
+			if code == exitOK {
+				code = exitUnknown
+			}
+			continue
+		}
+		for _, s := range data.Slots {
+			if s.Status == "FAILED" {
+				results = append(results, checkResult{Client: c.Name, Slot: s.ID, Problem: "slot failed: " + s.Reason})
+				code = exitCritical
+			}
+		}
+		for _, q := range data.Queues {
+			problem := ""
+			if q.Attempts >= checkMaxAttempts {
+				problem = fmt.Sprintf("stalled after %d attempts waiting on %s", q.Attempts, q.WaitingOn)
+			} else if timeout, err := time.Parse(time.RFC3339, q.Timeout); err == nil && now.After(timeout) && q.State != "SEND" {
+				problem = "stalled past its timeout"
+			}
+			if problem != "" {
+				results = append(results, checkResult{Client: c.Name, Slot: q.Slot, Queue: q.ID, Problem: problem})
+				code = exitCritical
+			}
+		}
+	}
+	if output == "json" {
+		printOutput(output, results, nil, nil)
+		return code
+	}
+	switch code {
+	case exitOK:
+		fmt.Printf("OK - %d clients checked\n", len(clients))
+	case exitCritical:
+		fmt.Printf("CRITICAL - %d problems\n", len(results))
+	default:
+		fmt.Printf("UNKNOWN - %d problems\n", len(results))
+	}
+	for _, r := range results {
+		fmt.Printf("%s slot=%s queue=%s: %s\n", r.Client, r.Slot, r.Queue, r.Problem)
+	}
+	return code
+}
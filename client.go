@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// clientTimeout is the deadline for a complete exchange with a FAH client
+const clientTimeout = 10 * time.Second
+
+// Client is a FAH client monitored by the exporter
+type Client struct {
+	Name     string
+	Address  string
+	Password string
+	Group    string
+
+	// Power sources, nil when none are configured
+	power *PowerMeter
+
+	mutex sync.Mutex
+	// Donor API data is throttled
+	donor      DonorAPI
+	lastUpdate time.Time
+	// Last collection result, raw is not redacted and must not be exported
+	last Snapshot
+	raw  Snapshot
+}
+
+// Snapshot is the result of a collection from a client
+type Snapshot struct {
+	Data  Metrics
+	Time  time.Time
+	Error error
+	// DownSince is the time of the first of the failed collections in a row, zero when up
+	DownSince time.Time
+}
+
+// Snapshot returns the last collection result, data older than maxAge is collected again
+func (c *Client) Snapshot(maxAge time.Duration) Snapshot {
+	last, _ := c.snapshots(maxAge)
+	return last
+}
+
+// lastSnapshot returns the last collection result without collecting, zero before the first collection
+func (c *Client) lastSnapshot() Snapshot {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last
+}
+
+// rawSnapshot is like Snapshot but the data is not redacted, for the config audit
+func (c *Client) rawSnapshot(maxAge time.Duration) Snapshot {
+	_, raw := c.snapshots(maxAge)
+	return raw
+}
+
+func (c *Client) snapshots(maxAge time.Duration) (last Snapshot, raw Snapshot) {
+	c.mutex.Lock()
+	last, raw = c.last, c.raw
+	c.mutex.Unlock()
+	if !last.Time.IsZero() && time.Since(last.Time) < maxAge {
+		return
+	}
+	c.Collect()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.last, c.raw
+}
+
+// NewClient creates a client from its configuration
+func NewClient(cfg ClientConfig) *Client {
+	c := &Client{
+		Name:     cfg.Name,
+		Address:  cfg.Address,
+		Password: cfg.Password,
+		Group:    cfg.Group,
+	}
+	if len(cfg.Power) > 0 {
+		power, err := NewPowerMeter(cfg.Power)
+		if err != nil {
+			log.Errorf("Ignoring power sources of %s: %v", cfg.Name, err)
+		} else {
+			c.power = power
+		}
+	}
+	return c
+}
+
+// dial connects and authenticates to the FAH client
+func (c *Client) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.Address, clientTimeout)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.SetDeadline(time.Now().Add(clientTimeout))
+	if err == nil && c.Password != "" {
+		err = writeCommand(conn, "auth "+c.Password)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if recorder != nil {
+		return &recordingConn{Conn: conn, client: c.Name}, nil
+	}
+	return conn, nil
+}
+
+// Collect reads all data from the FAH client
+func (c *Client) Collect() (data Metrics, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	defer func() {
+		prev := c.last
+		c.raw = Snapshot{Data: data, Time: time.Now(), Error: err}
+		if err != nil {
+			c.raw.DownSince = prev.DownSince
+			if prev.Error == nil {
+				c.raw.DownSince = c.raw.Time
+			}
+		}
+		c.last = c.raw
+		c.last.Data = privacy.Metrics(data)
+		if events != nil {
+			for _, e := range diffSnapshots(c.Name, prev, c.last) {
+				events.Publish(e)
+			}
+		}
+	}()
+	conn, err := c.dial()
+	if err != nil {
+		log.Errorf("Cannot connect to FAH client %s: %v", c.Name, err)
+		return
+	}
+	defer conn.Close()
+	err = ReadFAH(conn, "queue-info", &data.Queues)
+	if err != nil {
+		log.Errorf("Cannot read queue info: %v", err)
+		return
+	}
+	err = ReadFAH(conn, "slot-info", &data.Slots)
+	if err != nil {
+		log.Errorf("Cannot read slot info: %v", err)
+		return
+	}
+	data.SlotOptions = make(map[string]SlotOptions, len(data.Slots))
+	for _, s := range data.Slots {
+		// Slot options are optional, a failed slot is skipped rather than failing the client
+		var o SlotOptions
+		if optErr := ReadFAH(conn, fmt.Sprintf("slot-options %s -a", s.ID), &o); optErr != nil {
+			log.Errorf("Cannot read slot %s options: %v", s.ID, optErr)
+			continue
+		}
+		data.SlotOptions[s.ID] = o
+	}
+	err = ReadFAH(conn, "options", &data.Options)
+	if err != nil {
+		log.Errorf("Cannot read options: %v", err)
+		return
+	}
+	// Donor API errors contain the user, scrub it before the data is first redacted
+	privacy.Register(fieldUser, data.Options.User)
+	privacy.Register(fieldTeam, data.Options.Team)
+	privacy.Secret(data.Options.Passkey)
+	if getAPI {
+		if time.Since(c.lastUpdate).Seconds() > apiThrottle.Seconds() {
+			log.Debugf("Getting donor API data")
+			err = ReadAPI("/donor/"+data.Options.User, &c.donor)
+			if err != nil {
+				log.Errorf("Cannot get donor info from API: %v", err)
+			}
+			c.lastUpdate = time.Now()
+		}
+		data.Donor = c.donor
+	}
+	return
+}
+
+// Read sends a single command to the client and unmarshals the response into target
+func (c *Client) Read(cmd string, target interface{}) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return ReadFAH(conn, cmd, target)
+}
+
+// InfoSection is a section of the info command output, such as "System"
+type InfoSection struct {
+	Name   string      `json:"name"`
+	Values [][2]string `json:"values"`
+}
+
+// Info reads the info command output, a list of sections starting with their name
+// followed by key value pairs
+func (c *Client) Info() ([]InfoSection, error) {
+	var raw [][]interface{}
+	if err := c.Read("info", &raw); err != nil {
+		return nil, err
+	}
+	sections := make([]InfoSection, 0, len(raw))
+	for _, r := range raw {
+		if len(r) == 0 {
+			continue
+		}
+		section := InfoSection{Name: fmt.Sprint(r[0])}
+		for _, kv := range r[1:] {
+			pair, ok := kv.([]interface{})
+			if !ok || len(pair) != 2 {
+				continue
+			}
+			section.Values = append(section.Values, [2]string{fmt.Sprint(pair[0]), fmt.Sprint(pair[1])})
+		}
+		sections = append(sections, section)
+	}
+	return sections, nil
+}
+
+// pollClients collects every client each interval so snapshots and events stay up to date without scrapes
+func pollClients(set *ClientSet, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, c := range set.All() {
+			wg.Add(1)
+			go func(c *Client) {
+				defer wg.Done()
+				c.Collect()
+			}(c)
+		}
+		wg.Wait()
+		<-ticker.C
+	}
+}
+
+// SetOptions changes client options, the client replies with its options which are checked
+// against the change
+func (c *Client) SetOptions(options map[string]string) (actual Options, err error) {
+	err = c.setOptions("options", options, &actual)
+	return
+}
+
+// SetSlotOptions changes the options of a slot, like SetOptions
+func (c *Client) SetSlotOptions(slot string, options map[string]string) (actual SlotOptions, err error) {
+	if strings.ContainsAny(slot, " \t\r\n") {
+		err = fmt.Errorf("invalid slot %q", slot)
+		return
+	}
+	err = c.setOptions("slot-options "+slot, options, &actual)
+	return
+}
+
+// setOptions sends command with the options and unmarshals the reply into target,
+// options missing from the reply cannot be checked and are assumed to be set
+func (c *Client) setOptions(command string, options map[string]string, target interface{}) error {
+	args := make([]string, 0, len(options))
+	for k, v := range options {
+		if strings.ContainsAny(k+v, " \t\r\n") {
+			return fmt.Errorf("invalid value for option %s: %q", k, v)
+		}
+		args = append(args, k+"="+v)
+	}
+	sort.Strings(args)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	out, err := readPyON(conn, command+" "+strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	var reply map[string]interface{}
+	if err = json.Unmarshal([]byte(out), &reply); err != nil {
+		return err
+	}
+	for k, v := range options {
+		if actual, ok := reply[k]; ok && !strings.EqualFold(fmt.Sprint(actual), v) {
+			return fmt.Errorf("option %s is %v after setting it to %s", k, actual, v)
+		}
+	}
+	return json.Unmarshal([]byte(out), target)
+}
+
+// SlotCommand runs a slot command such as pause, unpause or finish, the slots are read back
+// so the command is processed before disconnecting
+func (c *Client) SlotCommand(command string, slot string) error {
+	if strings.ContainsAny(slot, " \t\r\n") {
+		return fmt.Errorf("invalid slot %q", slot)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = writeCommand(conn, command+" "+slot)
+	if err != nil {
+		return err
+	}
+	var slots []SlotInfo
+	return ReadFAH(conn, "slot-info", &slots)
+}
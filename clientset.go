@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// sourceConfig is the source of clients from the configuration file or command line
+const sourceConfig = "config"
+
+// ClientSet is the set of monitored clients, discovered clients are added and removed at runtime
+type ClientSet struct {
+	mutex   sync.RWMutex
+	clients []*Client
+	// Source of every client and its registered exporter, by client name
+	sources   map[string]string
+	exporters map[string]prometheus.Collector
+	// Label metrics by client when monitoring several clients
+	labelled bool
+	// Called after clients are added or removed
+	onChange func()
+}
+
+// NewClientSet creates an empty set, metrics have a client label when labelled is true
+func NewClientSet(labelled bool) *ClientSet {
+	return &ClientSet{
+		sources:   make(map[string]string),
+		exporters: make(map[string]prometheus.Collector),
+		labelled:  labelled,
+	}
+}
+
+// defaultClientName names a client after its address, which may be redacted
+func defaultClientName(address string) string {
+	if privacy == nil {
+		return address
+	}
+	if name := privacy.Apply(fieldAddress, address); name != "" {
+		return name
+	}
+	// Dropped addresses still need a unique name
+	return privacy.hash(address)
+}
+
+// All returns the clients sorted by name
+func (s *ClientSet) All() []*Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]*Client(nil), s.clients...)
+}
+
+// Get returns a client by name
+func (s *ClientSet) Get(name string) *Client {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, c := range s.clients {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Source returns where a client comes from, config or a discovery backend
+func (s *ClientSet) Source(name string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.sources[name]
+}
+
+// registerer registers the exporter of a client in reg, labelled with its name and group. Every client
+// has the group label, empty when it has none, as all series of a metric need the same labels.
+func (s *ClientSet) registerer(c *Client, reg prometheus.Registerer) prometheus.Registerer {
+	if !s.labelled {
+		return reg
+	}
+	return prometheus.WrapRegistererWith(prometheus.Labels{"client": c.Name, "group": c.Group}, reg)
+}
+
+// Gatherer returns the metrics of a single client, for scrapes with a target, nil when the
+// client is not monitored
+func (s *ClientSet) Gatherer(name string) prometheus.Gatherer {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, c := range s.clients {
+		if c.Name == name {
+			reg := prometheus.NewRegistry()
+			s.registerer(c, reg).MustRegister(s.exporters[name])
+			return reg
+		}
+	}
+	return nil
+}
+
+// add registers a client, the caller must hold the lock
+func (s *ClientSet) add(source string, cc ClientConfig) error {
+	if cc.Name == "" {
+		cc.Name = defaultClientName(cc.Address)
+	}
+	c := NewClient(cc)
+	exporter := NewExporter(c)
+	if err := s.registerer(c, prometheus.DefaultRegisterer).Register(exporter); err != nil {
+		return err
+	}
+	// Connection errors logged before the address is first exported contain it
+	privacy.Register(fieldAddress, c.Address)
+	privacy.Secret(c.Password)
+	s.clients = append(s.clients, c)
+	sort.Slice(s.clients, func(i, j int) bool { return s.clients[i].Name < s.clients[j].Name })
+	s.sources[c.Name] = source
+	s.exporters[c.Name] = exporter
+	return nil
+}
+
+// remove unregisters a client, the caller must hold the lock
+func (s *ClientSet) remove(name string) {
+	for i, c := range s.clients {
+		if c.Name == name {
+			s.registerer(c, prometheus.DefaultRegisterer).Unregister(s.exporters[name])
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	delete(s.sources, name)
+	delete(s.exporters, name)
+}
+
+// Add adds a client from the configuration
+func (s *ClientSet) Add(cc ClientConfig) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.add(sourceConfig, cc)
+}
+
+// Sync replaces the clients of a discovery source, clients already monitored under
+// the same name or address from another source are ignored
+func (s *ClientSet) Sync(source string, configs []ClientConfig) {
+	s.mutex.Lock()
+	wanted := make(map[string]bool, len(configs))
+	changed := false
+	for _, cc := range configs {
+		if cc.Name == "" {
+			cc.Name = defaultClientName(cc.Address)
+		}
+		wanted[cc.Name] = true
+		if existing, ok := s.sources[cc.Name]; ok {
+			if existing != source {
+				log.Debugf("Ignoring client %s from %s, already monitored from %s", cc.Name, source, existing)
+			}
+			continue
+		}
+		if s.monitors(cc.Address) {
+			log.Debugf("Ignoring client %s from %s, its address is already monitored", cc.Name, source)
+			continue
+		}
+		if err := s.add(source, cc); err != nil {
+			log.Errorf("Cannot add client %s from %s: %v", cc.Name, source, err)
+			continue
+		}
+		log.Infof("Discovered FAH client %s from %s", cc.Name, source)
+		changed = true
+	}
+	for name, src := range s.sources {
+		if src == source && !wanted[name] {
+			s.remove(name)
+			log.Infof("FAH client %s is no longer discovered by %s", name, source)
+			changed = true
+		}
+	}
+	onChange := s.onChange
+	s.mutex.Unlock()
+	if changed && onChange != nil {
+		onChange()
+	}
+}
+
+// monitors returns whether a client with the address exists, the caller must hold the lock
+func (s *ClientSet) monitors(address string) bool {
+	for _, c := range s.clients {
+		if c.Address == address {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Command fah-simulator serves the FAH v7 client protocol from scripted scenarios
+// or recorded capture files, so the exporter and dashboards can be used offline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	var (
+		listenAddress string
+		scenario      string
+		tick          time.Duration
+		replay        string
+		speed         float64
+		loop          bool
+		password      string
+		latency       time.Duration
+	)
+
+	flag.StringVar(&listenAddress, "listen-address", "127.0.0.1:36330", "Address to serve the FAH client protocol on")
+	flag.StringVar(&scenario, "scenario", "progress", "Scenario to simulate, see -list")
+	flag.DurationVar(&tick, "tick", 5*time.Second, "Time between simulation steps")
+	flag.StringVar(&replay, "replay", "", "Replay a capture file instead of simulating a scenario")
+	flag.Float64Var(&speed, "speed", 1, "Replay speed multiplier")
+	flag.BoolVar(&loop, "loop", false, "Restart the replay when the capture ends")
+	flag.StringVar(&password, "password", "", "Require clients to authenticate with this password")
+	flag.DurationVar(&latency, "latency", 0, "Delay every response")
+	list := flag.Bool("list", false, "List scenarios and exit")
+	flag.Parse()
+
+	if *list {
+		names := make([]string, 0, len(scenarios))
+		for name := range scenarios {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-15s %s\n", name, scenarios[name])
+		}
+		return
+	}
+
+	srv, err := fahtest.Listen(listenAddress)
+	if err != nil {
+		log.Fatalf("Cannot listen: %v", err)
+	}
+	srv.SetPassword(password)
+	srv.SetLatency(latency)
+
+	stop := make(chan struct{})
+	if replay != "" {
+		records, err := fahtest.ReadCaptureFile(replay)
+		if err != nil {
+			log.Fatalf("Cannot read capture: %v", err)
+		}
+		srv.Replay(records, speed, loop)
+		log.Infof("Replaying %d records from %s", len(records), replay)
+	} else {
+		if _, ok := scenarios[scenario]; !ok {
+			log.Fatalf("Unknown scenario %q", scenario)
+		}
+		sim := newSimulation(scenario, tick)
+		sim.handle(srv)
+		go sim.run(srv, stop)
+		log.Infof("Simulating scenario %s", scenario)
+	}
+	log.Infof("Serving FAH client protocol on %s", srv.Addr())
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
+	<-sig
+	close(stop)
+	srv.Close()
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+)
+
+// Scenarios which can be simulated
+var scenarios = map[string]string{
+	"progress":      "A GPU unit progressing frame by frame, a new unit is assigned when it finishes",
+	"pause":         "Like progress but the slot is paused for 5 ticks every 20 frames",
+	"failed-upload": "Finished units fail to upload and are retried with increasing delays",
+	"restart":       "Like progress but the client restarts every 30 ticks, dropping connections",
+}
+
+// unit is a work unit as reported by queue-info
+type unit struct {
+	ID             string `json:"id"`
+	State          string `json:"state"`
+	Error          string `json:"error"`
+	Project        int    `json:"project"`
+	Run            int    `json:"run"`
+	Clone          int    `json:"clone"`
+	Gen            int    `json:"gen"`
+	Core           string `json:"core"`
+	Unit           string `json:"unit"`
+	PercentDone    string `json:"percentdone"`
+	Eta            string `json:"eta"`
+	Ppd            string `json:"ppd"`
+	CreditEstimate string `json:"creditestimate"`
+	WaitingOn      string `json:"waitingon"`
+	NextAttempt    string `json:"nextattempt"`
+	TimeRemaining  string `json:"timeremaining"`
+	TotalFrames    int    `json:"totalframes"`
+	FramesDone     int    `json:"framesdone"`
+	Assigned       string `json:"assigned"`
+	Timeout        string `json:"timeout"`
+	Deadline       string `json:"deadline"`
+	Ws             string `json:"ws"`
+	Cs             string `json:"cs"`
+	Attempts       int    `json:"attempts"`
+	Slot           string `json:"slot"`
+	Tpf            string `json:"tpf"`
+	BaseCredit     string `json:"basecredit"`
+}
+
+// slot is a folding slot as reported by slot-info
+type slot struct {
+	ID          string                 `json:"id"`
+	Status      string                 `json:"status"`
+	Description string                 `json:"description"`
+	Options     map[string]interface{} `json:"options"`
+	Reason      string                 `json:"reason"`
+	Idle        bool                   `json:"idle"`
+}
+
+// simulation is the state of a simulated client, advanced once per tick
+type simulation struct {
+	scenario string
+	tick     time.Duration
+
+	mutex     sync.Mutex
+	ticks     int
+	frames    int
+	gen       int
+	assigned  time.Time
+	paused    bool
+	pausedFor int
+	// held is set by the pause command, finishing by the finish command
+	held       bool
+	finishing  bool
+	restarting bool
+	sending    bool
+	attempts   int
+	nextTry    int
+	// Client and slot options, changed with name=value arguments
+	options     map[string]interface{}
+	slotOptions map[string]interface{}
+}
+
+const (
+	totalFrames = 100
+	basePPD     = 1683157
+	baseCredit  = 9405
+)
+
+func newSimulation(scenario string, tick time.Duration) *simulation {
+	sim := &simulation{
+		scenario:    scenario,
+		tick:        tick,
+		assigned:    time.Now(),
+		options:     make(map[string]interface{}),
+		slotOptions: make(map[string]interface{}),
+	}
+	for k, v := range fahtest.SampleOptions {
+		sim.options[k] = v
+	}
+	for k, v := range fahtest.SampleSlotOptions {
+		sim.slotOptions[k] = v
+	}
+	return sim
+}
+
+// run advances the simulation until stop is closed
+func (sim *simulation) run(srv *fahtest.Server, stop chan struct{}) {
+	ticker := time.NewTicker(sim.tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		sim.mutex.Lock()
+		sim.step()
+		restarting := sim.restarting
+		sim.mutex.Unlock()
+		if restarting {
+			srv.Disconnect()
+		}
+	}
+}
+
+// step advances the simulation by one tick
+func (sim *simulation) step() {
+	sim.ticks++
+	if sim.held {
+		return
+	}
+	switch sim.scenario {
+	case "pause":
+		if sim.paused {
+			sim.pausedFor--
+			if sim.pausedFor == 0 {
+				// Resume on the next frame so the slot is not paused again
+				sim.paused = false
+				sim.frames++
+			}
+			return
+		}
+		if sim.frames > 0 && sim.frames%20 == 0 {
+			sim.paused = true
+			sim.pausedFor = 5
+			return
+		}
+	case "restart":
+		// Down for 3 ticks out of 30
+		sim.restarting = sim.ticks%30 < 3
+		if sim.restarting {
+			return
+		}
+	case "failed-upload":
+		if sim.sending {
+			if sim.ticks >= sim.nextTry {
+				sim.attempts++
+				sim.nextTry = sim.ticks + 1<<uint(sim.attempts)
+			}
+			return
+		}
+	}
+	if sim.frames < totalFrames {
+		sim.frames++
+		return
+	}
+	if !sim.sending {
+		// Finished units are sent before the next one is assigned
+		sim.sending = true
+		sim.nextTry = sim.ticks + 1
+		return
+	}
+	if sim.finishing {
+		// The slot pauses instead of folding another unit
+		sim.finishing = false
+		sim.held = true
+	}
+	sim.nextUnit()
+}
+
+func (sim *simulation) nextUnit() {
+	sim.frames = 0
+	sim.gen++
+	sim.assigned = time.Now()
+	sim.sending = false
+	sim.attempts = 0
+}
+
+func (sim *simulation) slots() []slot {
+	s := slot{
+		ID:          "01",
+		Status:      "RUNNING",
+		Description: "gpu:0:GP102 [GeForce GTX 1080 Ti] 11380",
+		Options:     map[string]interface{}{"paused": sim.paused || sim.held},
+	}
+	switch {
+	case sim.paused || sim.held:
+		s.Status = "PAUSED"
+		s.Reason = "paused"
+	case sim.sending:
+		s.Status = "READY"
+		s.Idle = true
+	}
+	return []slot{s}
+}
+
+func (sim *simulation) queues() []unit {
+	tpf := time.Duration(float64(time.Minute) * 1.25)
+	u := unit{
+		ID:             "01",
+		State:          "RUNNING",
+		Error:          "NO_ERROR",
+		Project:        13424,
+		Run:            0,
+		Clone:          1,
+		Gen:            sim.gen,
+		Core:           "0x22",
+		Unit:           fmt.Sprintf("0x%032x", 13424<<16+sim.gen),
+		PercentDone:    fmt.Sprintf("%.2f%%", float64(sim.frames)*100/totalFrames),
+		Eta:            formatDuration(time.Duration(totalFrames-sim.frames) * tpf),
+		Ppd:            fmt.Sprint(basePPD),
+		CreditEstimate: fmt.Sprint(baseCredit * 14),
+		NextAttempt:    "0.00 secs",
+		TimeRemaining:  formatDuration(time.Until(sim.assigned.Add(48 * time.Hour))),
+		TotalFrames:    totalFrames,
+		FramesDone:     sim.frames,
+		Assigned:       sim.assigned.UTC().Format(time.RFC3339),
+		Timeout:        sim.assigned.Add(24 * time.Hour).UTC().Format(time.RFC3339),
+		Deadline:       sim.assigned.Add(48 * time.Hour).UTC().Format(time.RFC3339),
+		Ws:             "128.252.203.10",
+		Cs:             "155.247.166.219",
+		Slot:           "01",
+		Tpf:            formatDuration(tpf),
+		BaseCredit:     fmt.Sprint(baseCredit),
+	}
+	switch {
+	case sim.paused || sim.held:
+		u.State = "READY"
+		u.Ppd = "0"
+	case sim.sending:
+		u.State = "SEND"
+		u.Ppd = "0"
+		u.WaitingOn = "Send Results"
+		u.Attempts = sim.attempts
+		u.NextAttempt = formatDuration(time.Duration(sim.nextTry-sim.ticks) * sim.tick)
+	}
+	return []unit{u}
+}
+
+// handle registers the command handlers serving the simulation state
+func (sim *simulation) handle(srv *fahtest.Server) {
+	respond := func(name string, data func() interface{}) fahtest.HandlerFunc {
+		return func([]string) fahtest.Response {
+			sim.mutex.Lock()
+			defer sim.mutex.Unlock()
+			if sim.restarting {
+				return fahtest.Response{Disconnect: true}
+			}
+			return fahtest.Response{Name: name, Payload: fahtest.MustPyON(data())}
+		}
+	}
+	srv.HandleSamples()
+	srv.HandleFunc("queue-info", respond("units", func() interface{} { return sim.queues() }))
+	srv.HandleFunc("slot-info", respond("slots", func() interface{} { return sim.slots() }))
+	// Options are set with name=value arguments and listed after the change
+	setOptions := func(name string, options map[string]interface{}) fahtest.HandlerFunc {
+		list := respond(name, func() interface{} { return options })
+		return func(args []string) fahtest.Response {
+			sim.mutex.Lock()
+			for _, arg := range args {
+				if k, v, ok := strings.Cut(arg, "="); ok {
+					options[k] = v
+				}
+			}
+			sim.mutex.Unlock()
+			return list(args)
+		}
+	}
+	srv.HandleFunc("options", setOptions("options", sim.options))
+	slotOptions := setOptions("slot-options", sim.slotOptions)
+	srv.HandleFunc("slot-options", func(args []string) fahtest.Response {
+		if len(args) == 0 || args[0] != "01" {
+			return fahtest.Response{Error: "Slot not found"}
+		}
+		return slotOptions(args[1:])
+	})
+	control := func(apply func()) fahtest.HandlerFunc {
+		return func(args []string) fahtest.Response {
+			if len(args) > 0 && args[0] != "01" {
+				return fahtest.Response{Error: fmt.Sprintf("Slot %s not found", args[0])}
+			}
+			sim.mutex.Lock()
+			defer sim.mutex.Unlock()
+			apply()
+			return fahtest.Response{}
+		}
+	}
+	srv.HandleFunc("pause", control(func() { sim.held = true }))
+	srv.HandleFunc("unpause", control(func() { sim.held, sim.finishing = false, false }))
+	srv.HandleFunc("finish", control(func() { sim.finishing = true }))
+}
+
+// formatDuration formats a duration like the FAH client, for example "2 hours 03 mins"
+func formatDuration(d time.Duration) string {
+	if d < 0 {
+		d = 0
+	}
+	switch {
+	case d >= 48*time.Hour:
+		return fmt.Sprintf("%.2f days", d.Hours()/24)
+	case d >= time.Hour:
+		return fmt.Sprintf("%d hours %02d mins", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%d mins %02d secs", int(d.Minutes()), int(d.Seconds())%60)
+	}
+	return fmt.Sprintf("%.2f secs", d.Seconds())
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the exporter configuration file
+type Config struct {
+	Clients []ClientConfig `yaml:"clients"`
+	// Desired is the fleet standard clients are audited against
+	Desired *DesiredState `yaml:"desired"`
+	// Remediate pushes the desired options back to drifted clients every RemediateInterval
+	Remediate         bool                `yaml:"remediate"`
+	RemediateInterval time.Duration       `yaml:"remediate_interval"`
+	Notifications     NotificationsConfig `yaml:"notifications"`
+	// MQTT publishes client data to a broker, disabled when nil
+	MQTT *MQTTConfig `yaml:"mqtt"`
+	// InfluxDB writes the metrics as line protocol, disabled when nil
+	InfluxDB *InfluxConfig `yaml:"influxdb"`
+	// RemoteWrite and Pushgateway push the metrics for clients which cannot be scraped, disabled when nil
+	RemoteWrite *RemoteWriteConfig `yaml:"remote_write"`
+	Pushgateway *PushgatewayConfig `yaml:"pushgateway"`
+	// OTLP exports the metrics to an OpenTelemetry collector, disabled when nil
+	OTLP *OTLPConfig `yaml:"otlp"`
+	// Privacy redacts identifying fields from exported data and logs, disabled when nil
+	Privacy *PrivacyConfig `yaml:"privacy"`
+	// Discovery finds clients in addition to the configured ones, disabled when nil
+	Discovery *DiscoveryConfig `yaml:"discovery"`
+	// Energy accounts the cost and emissions of the client power sources, disabled when nil
+	Energy *EnergyConfig `yaml:"energy"`
+}
+
+// ClientConfig is a FAH client to monitor
+type ClientConfig struct {
+	Name     string `yaml:"name"`
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	// Group of the client in the fleet aggregates, such as office or lab
+	Group string `yaml:"group"`
+	// Power sources of the client host and slots
+	Power []PowerSource `yaml:"power"`
+}
+
+// DesiredState is the desired client configuration, empty settings are not audited
+type DesiredState struct {
+	User       string `yaml:"user"`
+	Team       string `yaml:"team"`
+	PasskeySet *bool  `yaml:"passkey_set"`
+	Power      string `yaml:"power"`
+	Cause      string `yaml:"cause"`
+	// Slots is the slot layout by type, for example [cpu, gpu]
+	Slots []string `yaml:"slots"`
+}
+
+// loadConfig reads and validates the configuration file
+func loadConfig(path string) (cfg Config, err error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = yaml.UnmarshalStrict(b, &cfg)
+	if err != nil {
+		return
+	}
+	if cfg.RemediateInterval == 0 {
+		cfg.RemediateInterval = 5 * time.Minute
+	}
+	names := make(map[string]bool, len(cfg.Clients))
+	for i := range cfg.Clients {
+		c := &cfg.Clients[i]
+		if c.Address == "" {
+			err = fmt.Errorf("client %d has no address", i)
+			return
+		}
+		if c.Name == "" {
+			c.Name = c.Address
+		}
+		if names[c.Name] {
+			err = fmt.Errorf("duplicate client name %q", c.Name)
+			return
+		}
+		names[c.Name] = true
+		if _, err = NewPowerMeter(c.Power); err != nil {
+			err = fmt.Errorf("client %s: %w", c.Name, err)
+			return
+		}
+	}
+	return
+}
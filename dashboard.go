@@ -0,0 +1,292 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Dashboard views
+const (
+	viewHost  = "host"
+	viewFleet = "fleet"
+)
+
+var (
+	dashboardView       string
+	dashboardDatasource string
+	dashboardTitle      string
+)
+
+func dashboardFlags(fs *flag.FlagSet) {
+	fs.StringVar(&dashboardView, "dashboard.view", viewHost, "Dashboard view, a single host or the whole fleet (host, fleet)")
+	fs.StringVar(&dashboardDatasource, "dashboard.datasource", "Prometheus", "Name of the Prometheus datasource")
+	fs.StringVar(&dashboardTitle, "dashboard.title", "", "Dashboard title (default Folding@home or Folding@home fleet)")
+	fs.BoolVar(&getAPI, "fah.api", false, "Include donor panels, for exporters running with -fah.api")
+	fs.StringVar(&metricsSchema, "metrics.schema", schemaV1, "Metric schema of the exporters (v1, v2)")
+}
+
+// exportedMetrics returns the help of every metric the exporter defines with the current flags
+func exportedMetrics() map[string]string {
+	metrics := make(map[string]string)
+	for _, m := range exporterMetrics() {
+		if m.exported == nil || m.exported(nil) {
+			metrics[m.fqName()] = m.help
+		}
+	}
+	return metrics
+}
+
+// panelSpec describes a panel, its queries are built from metric selectors
+type panelSpec struct {
+	title   string
+	typ     string
+	width   int
+	height  int
+	unit    string
+	targets []targetSpec
+}
+
+// targetSpec is a query, %s in expr is replaced by the metric selector
+type targetSpec struct {
+	metric   string
+	matchers string
+	expr     string
+	legend   string
+}
+
+func stat(title string, t targetSpec) panelSpec {
+	return panelSpec{title: title, typ: "stat", width: 4, height: 4, targets: []targetSpec{t}}
+}
+
+func timeseries(title string, width int, unit string, targets ...targetSpec) panelSpec {
+	return panelSpec{title: title, typ: "timeseries", width: width, height: 8, unit: unit, targets: targets}
+}
+
+func table(title string, targets ...targetSpec) panelSpec {
+	return panelSpec{title: title, typ: "table", width: 12, height: 8, targets: targets}
+}
+
+// hostPanels shows the slots and units of a single client
+func hostPanels() []panelSpec {
+	return []panelSpec{
+		stat("Slots", targetSpec{metric: "fah_slot_count", expr: "sum(%s)"}),
+		stat("Running slots", targetSpec{metric: "fah_slot_status", matchers: `status="RUNNING"`, expr: "sum(%s)"}),
+		stat("Idle slots", targetSpec{metric: "fah_idle", expr: "sum(%s)"}),
+		stat("Units at risk", targetSpec{metric: "fah_unit_at_risk", expr: "sum(%s)"}),
+		stat("Donor credit", targetSpec{metric: "fah_donor_credit", expr: "max(%s)"}),
+		stat("Donor rank", targetSpec{metric: "fah_donor_rank", expr: "min(%s)"}),
+		timeseries("Points per day", 24, "short", targetSpec{metric: "fah_ppd", expr: "sum without (queue) (%s)", legend: "{{client}} slot {{slot}}"}),
+		timeseries("Percent done", 12, "percent", targetSpec{metric: "fah_percent_done", expr: "%s", legend: "{{client}} slot {{slot}} queue {{queue}}"}),
+		timeseries("Deadline margin", 12, "s", targetSpec{metric: "fah_unit_deadline_margin_seconds", expr: "%s", legend: "{{client}} slot {{slot}} queue {{queue}}"}),
+		timeseries("ETA", 12, "s", targetSpec{metric: "fah_queue_eta_seconds", expr: "%s", legend: "{{client}} slot {{slot}} queue {{queue}}"}),
+		timeseries("Time per frame", 12, "s", targetSpec{metric: "fah_queue_tpf_seconds", expr: "%s", legend: "{{client}} slot {{slot}} queue {{queue}}"}),
+		table("Slots",
+			targetSpec{metric: "fah_description", expr: "%s"},
+			targetSpec{metric: "fah_slot_status", expr: "%s == 1"}),
+		table("Work units",
+			targetSpec{metric: "fah_queue_state", expr: "%s == 1"},
+			targetSpec{metric: "fah_percent_done", expr: "%s"}),
+		timeseries("Donor credit", 12, "short", targetSpec{metric: "fah_donor_credit", expr: "%s", legend: "{{user}}"}),
+		timeseries("Team credit", 12, "short", targetSpec{metric: "fah_donor_team_credit", expr: "%s", legend: "{{name}}"}),
+	}
+}
+
+// fleetPanels aggregates every client
+func fleetPanels() []panelSpec {
+	return []panelSpec{
+		stat("Clients up", targetSpec{metric: "fah_up", expr: "sum(%s)"}),
+		stat("Clients down", targetSpec{metric: "fah_up", expr: "count(%s == 0) or vector(0)"}),
+		stat("Points per day", targetSpec{metric: "fah_ppd", expr: "sum(%s)"}),
+		stat("Slots", targetSpec{metric: "fah_slot_count", expr: "sum(%s)"}),
+		stat("Failed slots", targetSpec{metric: "fah_slot_status", matchers: `status="FAILED"`, expr: "sum(%s)"}),
+		stat("Units at risk", targetSpec{metric: "fah_unit_at_risk", expr: "sum(%s)"}),
+		timeseries("Points per day by client", 24, "short", targetSpec{metric: "fah_ppd", expr: "sum without (slot, queue) (%s)", legend: "{{instance}} {{client}}"}),
+		timeseries("Slots by status", 12, "short", targetSpec{metric: "fah_slot_status", expr: "sum by (status) (%s)", legend: "{{status}}"}),
+		timeseries("Units by state", 12, "short", targetSpec{metric: "fah_queue_state", expr: "sum by (state) (%s)", legend: "{{state}}"}),
+		table("Clients",
+			targetSpec{metric: "fah_up", expr: "%s"},
+			targetSpec{metric: "fah_slot_count", expr: "%s"}),
+		table("Units at risk", targetSpec{metric: "fah_unit_deadline_margin_seconds", expr: "%s < 0"}),
+		timeseries("Donor credit", 12, "short", targetSpec{metric: "fah_donor_credit", expr: "max by (user) (%s)", legend: "{{user}}"}),
+		timeseries("Team credit", 12, "short", targetSpec{metric: "fah_donor_team_credit", expr: "max by (name) (%s)", legend: "{{name}}"}),
+	}
+}
+
+// Grafana dashboard model, only the fields set by the generator
+type gDashboard struct {
+	Title         string      `json:"title"`
+	UID           string      `json:"uid"`
+	Tags          []string    `json:"tags"`
+	Editable      bool        `json:"editable"`
+	Refresh       string      `json:"refresh"`
+	SchemaVersion int         `json:"schemaVersion"`
+	Time          gTimeRange  `json:"time"`
+	Templating    gTemplating `json:"templating"`
+	Panels        []gPanel    `json:"panels"`
+}
+
+type gTimeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+type gTemplating struct {
+	List []gVariable `json:"list"`
+}
+
+type gVariable struct {
+	Name       string `json:"name"`
+	Label      string `json:"label"`
+	Type       string `json:"type"`
+	Datasource string `json:"datasource"`
+	Query      string `json:"query"`
+	Refresh    int    `json:"refresh"`
+	IncludeAll bool   `json:"includeAll"`
+	Multi      bool   `json:"multi"`
+	AllValue   string `json:"allValue,omitempty"`
+}
+
+type gPanel struct {
+	ID          int          `json:"id"`
+	Title       string       `json:"title"`
+	Type        string       `json:"type"`
+	Description string       `json:"description,omitempty"`
+	Datasource  string       `json:"datasource"`
+	GridPos     gGridPos     `json:"gridPos"`
+	FieldConfig gFieldConfig `json:"fieldConfig"`
+	Targets     []gTarget    `json:"targets"`
+}
+
+type gGridPos struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+type gFieldConfig struct {
+	Defaults struct {
+		Unit string `json:"unit,omitempty"`
+	} `json:"defaults"`
+}
+
+type gTarget struct {
+	RefID        string `json:"refId"`
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat,omitempty"`
+	Instant      bool   `json:"instant,omitempty"`
+	Format       string `json:"format,omitempty"`
+}
+
+// generateDashboard builds the dashboard of a view, panels using metrics the exporter does not define
+// with the current flags, such as donor metrics without -fah.api, are left out
+func generateDashboard(view string) (gDashboard, error) {
+	metrics := exportedMetrics()
+	d := gDashboard{
+		Tags:          []string{"fah", "folding@home"},
+		Editable:      true,
+		Refresh:       "1m",
+		SchemaVersion: 36,
+		Time:          gTimeRange{From: "now-24h", To: "now"},
+	}
+	var (
+		specs    []panelSpec
+		selector string
+	)
+	switch view {
+	case viewHost:
+		d.Title, d.UID = "Folding@home", "fah-host"
+		specs = hostPanels()
+		selector = `instance="$instance",client=~"$client"`
+		d.Templating.List = []gVariable{
+			{Name: "instance", Label: "Instance", Type: "query", Datasource: dashboardDatasource,
+				Query: "label_values(fah_up, instance)", Refresh: 2},
+			// Only set when the exporter monitors several clients
+			{Name: "client", Label: "Client", Type: "query", Datasource: dashboardDatasource,
+				Query: `label_values(fah_up{instance="$instance"}, client)`, Refresh: 2, IncludeAll: true, Multi: true, AllValue: ".*"},
+		}
+	case viewFleet:
+		d.Title, d.UID = "Folding@home fleet", "fah-fleet"
+		specs = fleetPanels()
+		selector = `job=~"$job"`
+		d.Templating.List = []gVariable{
+			{Name: "job", Label: "Job", Type: "query", Datasource: dashboardDatasource,
+				Query: "label_values(fah_up, job)", Refresh: 2, IncludeAll: true, Multi: true, AllValue: ".*"},
+		}
+	default:
+		return d, fmt.Errorf("unknown dashboard view %q", view)
+	}
+	if dashboardTitle != "" {
+		d.Title = dashboardTitle
+	}
+
+	x, y, rowHeight := 0, 0, 0
+	for _, s := range specs {
+		p := gPanel{
+			ID:         len(d.Panels) + 1,
+			Title:      s.title,
+			Type:       s.typ,
+			Datasource: dashboardDatasource,
+		}
+		p.FieldConfig.Defaults.Unit = s.unit
+		for i, t := range s.targets {
+			help, ok := metrics[t.metric]
+			if !ok {
+				p.Targets = nil
+				break
+			}
+			if p.Description == "" {
+				p.Description = help
+			}
+			matchers := selector
+			if t.matchers != "" {
+				matchers += "," + t.matchers
+			}
+			gt := gTarget{
+				RefID:        string(rune('A' + i)),
+				Expr:         fmt.Sprintf(t.expr, t.metric+"{"+matchers+"}"),
+				LegendFormat: t.legend,
+			}
+			if s.typ == "table" {
+				gt.Instant, gt.Format = true, "table"
+			}
+			p.Targets = append(p.Targets, gt)
+		}
+		if len(p.Targets) == 0 {
+			continue
+		}
+		// Fill rows left to right
+		if x+s.width > 24 {
+			x, y, rowHeight = 0, y+rowHeight, 0
+		}
+		p.GridPos = gGridPos{X: x, Y: y, W: s.width, H: s.height}
+		x += s.width
+		if s.height > rowHeight {
+			rowHeight = s.height
+		}
+		d.Panels = append(d.Panels, p)
+	}
+	return d, nil
+}
+
+// runDashboard prints the dashboard JSON
+func runDashboard(output string) int {
+	if metricsSchema != schemaV1 && metricsSchema != schemaV2 {
+		fmt.Fprintf(os.Stderr, "Unknown metric schema %q\n", metricsSchema)
+		return exitUnknown
+	}
+	d, err := generateDashboard(dashboardView)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot generate dashboard: %v\n", err)
+		return exitUnknown
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot generate dashboard: %v\n", err)
+		return exitUnknown
+	}
+	return exitOK
+}
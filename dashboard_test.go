@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestDashboardMetrics(t *testing.T) {
+	getAPI = true
+	metricsSchema = schemaV2
+	defer func() { getAPI, metricsSchema = false, schemaV1 }()
+	known := make(map[string]bool)
+	for _, m := range exporterMetrics() {
+		known[m.fqName()] = true
+	}
+	for _, view := range []string{viewHost, viewFleet} {
+		d, err := generateDashboard(view)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Every panel is kept with the donor metrics and schema v2
+		specs := hostPanels()
+		if view == viewFleet {
+			specs = fleetPanels()
+		}
+		if len(d.Panels) != len(specs) {
+			t.Errorf("%s view has %d panels, want %d", view, len(d.Panels), len(specs))
+		}
+		for _, p := range d.Panels {
+			for _, target := range p.Targets {
+				expr, err := parser.ParseExpr(target.Expr)
+				if err != nil {
+					t.Errorf("%s panel %q: %v", view, p.Title, err)
+					continue
+				}
+				selectors := 0
+				parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+					if vs, ok := node.(*parser.VectorSelector); ok {
+						selectors++
+						if !known[vs.Name] {
+							t.Errorf("%s panel %q uses %s which the exporter does not define", view, p.Title, vs.Name)
+						}
+					}
+					return nil
+				})
+				if selectors == 0 {
+					t.Errorf("%s panel %q query %q has no metric", view, p.Title, target.Expr)
+				}
+			}
+		}
+	}
+}
+
+// TestExporterMetricsTable checks that the exporter exports the metrics of the table
+func TestExporterMetricsTable(t *testing.T) {
+	for _, schema := range []string{schemaV1, schemaV2} {
+		metricsSchema = schema
+		specs := make(map[string]metricSpec)
+		for _, m := range exporterMetrics() {
+			specs[m.fqName()] = m
+		}
+		reg := prometheus.NewPedanticRegistry()
+		reg.MustRegister(NewExporter(NewClient(ClientConfig{Name: "table", Address: newTestServer(t).Addr()})))
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, mf := range families {
+			spec, ok := specs[mf.GetName()]
+			if !ok {
+				t.Errorf("schema %s: %s is not in the table", schema, mf.GetName())
+				continue
+			}
+			if mf.GetHelp() != spec.help {
+				t.Errorf("schema %s: %s help is %q, want %q", schema, mf.GetName(), mf.GetHelp(), spec.help)
+			}
+			for _, m := range mf.GetMetric() {
+				if len(m.GetLabel()) != len(spec.labels) {
+					t.Errorf("schema %s: %s has labels %v, want %v", schema, mf.GetName(), m.GetLabel(), spec.labels)
+					break
+				}
+			}
+		}
+	}
+	metricsSchema = schemaV1
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+	"gopkg.in/yaml.v2"
+)
+
+// DiscoveryConfig configures finding clients in addition to the configured ones
+type DiscoveryConfig struct {
+	// Files list clients in the format of the clients section, they are reloaded when changed
+	Files []string             `yaml:"files"`
+	DNS   []DNSDiscoveryConfig `yaml:"dns"`
+	MDNS  *MDNSDiscoveryConfig `yaml:"mdns"`
+	Scan  []ScanConfig         `yaml:"scan"`
+	// Password and Group of clients found by DNS, mDNS and scans
+	Password string `yaml:"password"`
+	Group    string `yaml:"group"`
+	// RefreshInterval of DNS, mDNS and scans
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	// FileSDPath is written with the targets in the Prometheus file_sd format
+	FileSDPath string `yaml:"file_sd_path"`
+	// ExporterAddress is the address Prometheus scrapes the exporter on in the file_sd and
+	// http_sd targets, the listen address with the host name when unset
+	ExporterAddress string `yaml:"exporter_address"`
+}
+
+// DNSDiscoveryConfig looks up clients from SRV records, or A/AAAA records with a fixed port
+type DNSDiscoveryConfig struct {
+	Name string `yaml:"name"`
+	// Type is SRV (default) or A
+	Type string `yaml:"type"`
+	Port int    `yaml:"port"`
+}
+
+// MDNSDiscoveryConfig browses for a DNS-SD service on the local network
+type MDNSDiscoveryConfig struct {
+	Service string        `yaml:"service"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// ScanConfig probes every address of a network for the FAH command server
+type ScanConfig struct {
+	CIDR    string        `yaml:"cidr"`
+	Port    int           `yaml:"port"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// maxScanHosts bounds the size of scanned networks
+const maxScanHosts = 1 << 16
+
+// scanWorkers is the number of concurrent probes of a scan
+const scanWorkers = 64
+
+// Discovery runs the discovery backends and feeds the client set
+type Discovery struct {
+	cfg    DiscoveryConfig
+	set    *ClientSet
+	scrape sdScrape
+	// Serializes writing the file_sd output
+	mutex sync.Mutex
+}
+
+// NewDiscovery validates the configuration and applies defaults, the file_sd targets scrape the exporter at scrape
+func NewDiscovery(cfg DiscoveryConfig, set *ClientSet, scrape sdScrape) (*Discovery, error) {
+	if cfg.RefreshInterval == 0 {
+		cfg.RefreshInterval = 5 * time.Minute
+	}
+	for i := range cfg.DNS {
+		d := &cfg.DNS[i]
+		d.Type = strings.ToUpper(d.Type)
+		if d.Type == "" {
+			d.Type = "SRV"
+		}
+		if d.Name == "" {
+			return nil, fmt.Errorf("dns discovery %d has no name", i)
+		}
+		if d.Type != "SRV" && d.Type != "A" {
+			return nil, fmt.Errorf("unsupported dns discovery type %q", d.Type)
+		}
+		if d.Port == 0 {
+			d.Port = 36330
+		}
+	}
+	if m := cfg.MDNS; m != nil {
+		if m.Service == "" {
+			m.Service = "_fah._tcp"
+		}
+		if m.Timeout == 0 {
+			m.Timeout = 2 * time.Second
+		}
+	}
+	for i := range cfg.Scan {
+		s := &cfg.Scan[i]
+		_, network, err := net.ParseCIDR(s.CIDR)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan network: %w", err)
+		}
+		ones, bits := network.Mask.Size()
+		if bits-ones > 16 {
+			return nil, fmt.Errorf("scan network %s is larger than %d addresses", s.CIDR, maxScanHosts)
+		}
+		if s.Port == 0 {
+			s.Port = 36330
+		}
+		if s.Timeout == 0 {
+			s.Timeout = time.Second
+		}
+		// Scans running longer than the refresh interval would run back to back
+		if d := scanDuration(bits-ones, s.Timeout); d > cfg.RefreshInterval {
+			return nil, fmt.Errorf("scan of %s takes up to %s, longer than the refresh interval %s", s.CIDR, d, cfg.RefreshInterval)
+		}
+	}
+	d := &Discovery{cfg: cfg, set: set, scrape: scrape}
+	set.onChange = d.writeFileSD
+	return d, nil
+}
+
+// Run starts every backend, it returns immediately
+func (d *Discovery) Run() {
+	for _, path := range d.cfg.Files {
+		go d.watchFile(path)
+	}
+	for _, dc := range d.cfg.DNS {
+		dc := dc
+		go d.refresh("dns:"+dc.Name, func() ([]ClientConfig, error) { return d.lookupDNS(dc) })
+	}
+	if d.cfg.MDNS != nil {
+		go d.refresh("mdns", d.browseMDNS)
+	}
+	for _, sc := range d.cfg.Scan {
+		sc := sc
+		go d.refresh("scan:"+sc.CIDR, func() ([]ClientConfig, error) { return d.scan(sc) })
+	}
+	d.writeFileSD()
+}
+
+// refresh runs a backend every refresh interval, the clients are kept when it fails
+func (d *Discovery) refresh(source string, discover func() ([]ClientConfig, error)) {
+	ticker := time.NewTicker(d.cfg.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		configs, err := discover()
+		if err != nil {
+			log.Errorf("Cannot discover clients from %s: %v", source, err)
+		} else {
+			d.set.Sync(source, configs)
+		}
+		<-ticker.C
+	}
+}
+
+// discovered returns a client found by DNS, mDNS or a scan
+func (d *Discovery) discovered(name string, address string) ClientConfig {
+	return ClientConfig{Name: name, Address: address, Password: d.cfg.Password, Group: d.cfg.Group}
+}
+
+// readClientsFile reads a list of clients in the format of the clients section
+func readClientsFile(path string) ([]ClientConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs []ClientConfig
+	if err := yaml.UnmarshalStrict(b, &configs); err != nil {
+		return nil, err
+	}
+	for i, c := range configs {
+		if c.Address == "" {
+			return nil, fmt.Errorf("client %d has no address", i)
+		}
+		if _, err := NewPowerMeter(c.Power); err != nil {
+			return nil, fmt.Errorf("client %d: %w", i, err)
+		}
+	}
+	return configs, nil
+}
+
+// watchFile loads a clients file and reloads it when it changes, the directory is watched
+// since editors and config management replace files rather than writing them
+func (d *Discovery) watchFile(path string) {
+	source := "file:" + path
+	load := func() {
+		configs, err := readClientsFile(path)
+		if err != nil {
+			log.Errorf("Cannot load clients from %s: %v", path, err)
+			return
+		}
+		d.set.Sync(source, configs)
+	}
+	load()
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = watcher.Add(filepath.Dir(path))
+	}
+	if err != nil {
+		log.Errorf("Cannot watch %s, changes are not reloaded: %v", path, err)
+		return
+	}
+	defer watcher.Close()
+	for {
+		select {
+		case e, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(e.Name) == filepath.Clean(path) && e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) != 0 {
+				load()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Errorf("Cannot watch %s: %v", path, err)
+		}
+	}
+}
+
+// lookupDNS resolves the clients of a SRV or A record
+func (d *Discovery) lookupDNS(dc DNSDiscoveryConfig) ([]ClientConfig, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	var configs []ClientConfig
+	if dc.Type == "SRV" {
+		_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", dc.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range records {
+			configs = append(configs, d.discovered("", net.JoinHostPort(strings.TrimSuffix(r.Target, "."), strconv.Itoa(int(r.Port)))))
+		}
+		return configs, nil
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, dc.Name)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		configs = append(configs, d.discovered("", net.JoinHostPort(a, strconv.Itoa(dc.Port))))
+	}
+	return configs, nil
+}
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// browseMDNS sends a DNS-SD query for the service and collects the answers until the timeout,
+// clients are named after their service instance
+func (d *Discovery) browseMDNS() ([]ClientConfig, error) {
+	service, err := dnsmessage.NewName(strings.TrimSuffix(d.cfg.MDNS.Service, ".") + ".local.")
+	if err != nil {
+		return nil, err
+	}
+	query := dnsmessage.Message{
+		Questions: []dnsmessage.Question{{Name: service, Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET}},
+	}
+	packet, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	// Queries from a port other than 5353 are answered with unicast
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.WriteToUDP(packet, mdnsGroup); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(d.cfg.MDNS.Timeout))
+
+	var (
+		instances = make(map[string]bool)
+		srvs      = make(map[string]dnsmessage.SRVResource)
+		hosts     = make(map[string]string)
+		buf       = make([]byte, 9000)
+	)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			// The timeout ends the browse
+			break
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil {
+			continue
+		}
+		for _, r := range append(msg.Answers, msg.Additionals...) {
+			switch body := r.Body.(type) {
+			case *dnsmessage.PTRResource:
+				if r.Header.Name.String() == service.String() {
+					instances[body.PTR.String()] = true
+				}
+			case *dnsmessage.SRVResource:
+				srvs[r.Header.Name.String()] = *body
+			case *dnsmessage.AResource:
+				hosts[r.Header.Name.String()] = net.IP(body.A[:]).String()
+			}
+		}
+	}
+	var configs []ClientConfig
+	for instance := range instances {
+		srv, ok := srvs[instance]
+		if !ok {
+			continue
+		}
+		host, ok := hosts[srv.Target.String()]
+		if !ok {
+			host = strings.TrimSuffix(srv.Target.String(), ".")
+		}
+		name := strings.TrimSuffix(instance, "."+service.String())
+		configs = append(configs, d.discovered(name, net.JoinHostPort(host, strconv.Itoa(int(srv.Port)))))
+	}
+	return configs, nil
+}
+
+// scan probes every host of a network, clients are the hosts answering with the FAH banner
+func (d *Discovery) scan(sc ScanConfig) ([]ClientConfig, error) {
+	ip, network, err := net.ParseCIDR(sc.CIDR)
+	if err != nil {
+		return nil, err
+	}
+	addresses := make(chan string)
+	go func() {
+		defer close(addresses)
+		for ip := ip.Mask(network.Mask); network.Contains(ip); ip = nextIP(ip) {
+			addresses <- net.JoinHostPort(ip.String(), strconv.Itoa(sc.Port))
+		}
+	}()
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		configs []ClientConfig
+	)
+	for i := 0; i < scanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for a := range addresses {
+				if probeFAH(a, sc.Timeout) {
+					mutex.Lock()
+					configs = append(configs, d.discovered("", a))
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return configs, nil
+}
+
+// scanDuration is the longest time a scan of 2^hostBits addresses takes, when no host answers
+func scanDuration(hostBits int, timeout time.Duration) time.Duration {
+	rounds := (1<<hostBits + scanWorkers - 1) / scanWorkers
+	return time.Duration(rounds) * timeout
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := append(net.IP(nil), ip...)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
+
+// probeFAH returns whether the address runs the FAH command server, which greets with a banner
+func probeFAH(address string, timeout time.Duration) bool {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	return strings.Contains(line, "Folding@home")
+}
+
+// target is a monitored client in /api/v1/targets
+type target struct {
+	Name    string `json:"name"`
+	Address string `json:"address"`
+	Group   string `json:"group,omitempty"`
+	Source  string `json:"source"`
+}
+
+// sdScrape is where Prometheus scrapes the exporter for the file_sd and http_sd targets
+type sdScrape struct {
+	Address     string
+	MetricsPath string
+}
+
+// newSDScrape scrapes the listen address, with the host name when listening on every address
+func newSDScrape(listenAddress, metricsPath string) sdScrape {
+	host, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return sdScrape{Address: listenAddress, MetricsPath: metricsPath}
+	}
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if hostname, err := os.Hostname(); err == nil {
+			host = hostname
+		}
+	}
+	return sdScrape{Address: net.JoinHostPort(host, port), MetricsPath: metricsPath}
+}
+
+// sdGroup is a target group of the Prometheus file_sd and http_sd formats
+type sdGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+func targets(set *ClientSet) []target {
+	clients := set.All()
+	list := make([]target, 0, len(clients))
+	for _, c := range clients {
+		list = append(list, target{
+			Name:    c.Name,
+			Address: privacy.Apply(fieldAddress, c.Address),
+			Group:   c.Group,
+			Source:  set.Source(c.Name),
+		})
+	}
+	return list
+}
+
+// sdGroups returns one target group per client, scraping the exporter with the client as the target
+// parameter. The client metrics already have the client and group labels, they are meta labels here
+// so Prometheus does not rename them to exported_client and exported_group.
+func sdGroups(set *ClientSet, scrape sdScrape) []sdGroup {
+	list := targets(set)
+	groups := make([]sdGroup, 0, len(list))
+	for _, t := range list {
+		labels := map[string]string{
+			"__param_target":    t.Name,
+			"__meta_fah_client": t.Name,
+			"__meta_fah_source": t.Source,
+		}
+		if t.Group != "" {
+			labels["__meta_fah_group"] = t.Group
+		}
+		if scrape.MetricsPath != "/metrics" {
+			labels["__metrics_path__"] = scrape.MetricsPath
+		}
+		groups = append(groups, sdGroup{Targets: []string{scrape.Address}, Labels: labels})
+	}
+	return groups
+}
+
+// writeFileSD writes the targets to the file_sd output, replacing it atomically
+func (d *Discovery) writeFileSD() {
+	if d.cfg.FileSDPath == "" {
+		return
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	b, err := json.MarshalIndent(sdGroups(d.set, d.scrape), "", "  ")
+	if err == nil {
+		tmp := d.cfg.FileSDPath + ".tmp"
+		if err = os.WriteFile(tmp, b, 0o644); err == nil {
+			err = os.Rename(tmp, d.cfg.FileSDPath)
+		}
+	}
+	if err != nil {
+		log.Errorf("Cannot write file_sd targets: %v", err)
+	}
+}
+
+// targetsHandler serves the monitored clients, and the Prometheus http_sd format at /api/v1/targets/sd
+func targetsHandler(set *ClientSet, scrape sdScrape) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/v1/targets"), "/") {
+		case "":
+			writeJSON(w, http.StatusOK, targets(set))
+		case "sd":
+			writeJSON(w, http.StatusOK, sdGroups(set, scrape))
+		default:
+			writeJSONError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
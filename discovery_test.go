@@ -0,0 +1,206 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+)
+
+func TestSDGroups(t *testing.T) {
+	srv := newTestServer(t)
+	set := NewClientSet(true)
+	if err := set.Add(ClientConfig{Name: "sd-a", Address: srv.Addr(), Group: "lab"}); err != nil {
+		t.Fatal(err)
+	}
+	defer set.remove("sd-a")
+
+	groups := sdGroups(set, sdScrape{Address: "exporter:9659", MetricsPath: "/fah"})
+	expected := []sdGroup{{
+		Targets: []string{"exporter:9659"},
+		Labels: map[string]string{
+			"__param_target":    "sd-a",
+			"__meta_fah_client": "sd-a",
+			"__meta_fah_group":  "lab",
+			"__meta_fah_source": sourceConfig,
+			"__metrics_path__":  "/fah",
+		},
+	}}
+	if !reflect.DeepEqual(groups, expected) {
+		t.Errorf("got %+v, want %+v", groups, expected)
+	}
+}
+
+func TestMetricsTarget(t *testing.T) {
+	srv := newTestServer(t)
+	set := NewClientSet(true)
+	for _, name := range []string{"target-a", "target-b"} {
+		if err := set.Add(ClientConfig{Name: name, Address: srv.Addr()}); err != nil {
+			t.Fatal(err)
+		}
+		defer set.remove(name)
+	}
+	handler := metricsHandler(set)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?target=target-a", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `fah_up{client="target-a",group=""} 1`) {
+		t.Errorf("target-a metrics missing:\n%s", body)
+	}
+	if strings.Contains(body, "target-b") || strings.Contains(body, "go_goroutines") {
+		t.Errorf("target scrape has metrics of other targets:\n%s", body)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics?target=unknown", nil))
+	if rec.Code != 404 {
+		t.Errorf("unknown target returned %d", rec.Code)
+	}
+}
+
+func TestDiscoveryScanDuration(t *testing.T) {
+	cases := []struct {
+		cidr    string
+		timeout time.Duration
+		refresh time.Duration
+		valid   bool
+	}{
+		{"192.168.1.0/24", time.Second, 5 * time.Minute, true},
+		{"10.0.0.0/16", time.Second, 5 * time.Minute, false},
+		{"10.0.0.0/16", 100 * time.Millisecond, 5 * time.Minute, true},
+		{"10.0.0.0/16", time.Second, 30 * time.Minute, true},
+		{"10.0.0.0/15", 10 * time.Millisecond, time.Hour, false},
+	}
+	for _, c := range cases {
+		cfg := DiscoveryConfig{Scan: []ScanConfig{{CIDR: c.cidr, Timeout: c.timeout}}, RefreshInterval: c.refresh}
+		_, err := NewDiscovery(cfg, NewClientSet(true), sdScrape{})
+		if (err == nil) != c.valid {
+			t.Errorf("%s with timeout %s and refresh %s: got error %v", c.cidr, c.timeout, c.refresh, err)
+		}
+	}
+}
+
+// clientNames returns the names of the clients in the set
+func clientNames(set *ClientSet) []string {
+	var names []string
+	for _, c := range set.All() {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func TestDiscoveryWatchFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "clients.yml")
+	// Editors and config management replace the file rather than writing it
+	write := func(content string) {
+		tmp := filepath.Join(dir, "clients.yml.tmp")
+		if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("- name: watch-a\n  address: 127.0.0.1:1\n- name: watch-b\n  address: 127.0.0.1:2\n")
+
+	set := NewClientSet(true)
+	defer func() {
+		for _, name := range clientNames(set) {
+			set.remove(name)
+		}
+	}()
+	d, err := NewDiscovery(DiscoveryConfig{Files: []string{path}}, set, sdScrape{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go d.watchFile(path)
+	expect := func(names ...string) {
+		t.Helper()
+		if !eventually(func() bool { return reflect.DeepEqual(clientNames(set), names) }) {
+			t.Fatalf("clients %v, want %v", clientNames(set), names)
+		}
+	}
+	expect("watch-a", "watch-b")
+	if source := set.Source("watch-a"); source != "file:"+path {
+		t.Errorf("watch-a has source %q", source)
+	}
+
+	write("- name: watch-b\n  address: 127.0.0.1:2\n- name: watch-c\n  address: 127.0.0.1:3\n")
+	expect("watch-b", "watch-c")
+	// Invalid files keep the clients
+	write("- name: watch-d\n")
+	time.Sleep(100 * time.Millisecond)
+	expect("watch-b", "watch-c")
+	write("[]\n")
+	expect()
+}
+
+func TestDiscoveryScan(t *testing.T) {
+	first := newTestServer(t)
+	_, port, _ := net.SplitHostPort(first.Addr())
+	second, err := fahtest.Listen(net.JoinHostPort("127.0.0.2", port))
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.2: %v", err)
+	}
+	defer second.Close()
+	// Other services on the port are not clients
+	other, err := net.Listen("tcp", net.JoinHostPort("127.0.0.3", port))
+	if err != nil {
+		t.Skipf("cannot listen on 127.0.0.3: %v", err)
+	}
+	defer other.Close()
+	go func() {
+		for {
+			conn, err := other.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte("SSH-2.0-OpenSSH\r\n"))
+			conn.Close()
+		}
+	}()
+
+	p, _ := net.LookupPort("tcp", port)
+	set := NewClientSet(true)
+	d, err := NewDiscovery(DiscoveryConfig{
+		Scan:     []ScanConfig{{CIDR: "127.0.0.0/29", Port: p, Timeout: 200 * time.Millisecond}},
+		Password: "secret",
+		Group:    "lab",
+	}, set, sdScrape{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configs, err := d.scan(d.cfg.Scan[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(configs, func(i, j int) bool { return configs[i].Address < configs[j].Address })
+	want := []ClientConfig{
+		{Address: first.Addr(), Password: "secret", Group: "lab"},
+		{Address: second.Addr(), Password: "secret", Group: "lab"},
+	}
+	if !reflect.DeepEqual(configs, want) {
+		t.Fatalf("found %+v, want %+v", configs, want)
+	}
+
+	source := "scan:127.0.0.0/29"
+	set.Sync(source, configs)
+	defer set.Sync(source, nil)
+	if names := clientNames(set); !reflect.DeepEqual(names, []string{first.Addr(), second.Addr()}) {
+		t.Errorf("clients %v", names)
+	}
+	// Clients no longer found are removed
+	set.Sync(source, configs[1:])
+	if names := clientNames(set); !reflect.DeepEqual(names, []string{second.Addr()}) {
+		t.Errorf("clients %v after the first client left", names)
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Drift is the comparison of one setting against the desired state
+type Drift struct {
+	Setting string `json:"setting"`
+	// Slot of slot settings, empty for client settings
+	Slot    string `json:"slot,omitempty"`
+	Desired string `json:"desired"`
+	Actual  string `json:"actual"`
+	Drift   bool   `json:"drift"`
+}
+
+// ClientDrift is the drift report of one client
+type ClientDrift struct {
+	Client   string  `json:"client"`
+	Error    string  `json:"error,omitempty"`
+	Settings []Drift `json:"settings"`
+}
+
+// remediable maps settings which can be changed with the options command to their option name
+var remediable = map[string]string{
+	"user":  "user",
+	"team":  "team",
+	"power": "power",
+	"cause": "cause",
+}
+
+func newDrift(setting string, desired string, actual string) Drift {
+	return Drift{
+		Setting: setting,
+		Desired: desired,
+		Actual:  actual,
+		Drift:   !strings.EqualFold(desired, actual),
+	}
+}
+
+// slotLayout returns the sorted slot types, taken from the slot descriptions such as "gpu:0:GP102"
+func slotLayout(slots []SlotInfo) []string {
+	layout := make([]string, 0, len(slots))
+	for _, s := range slots {
+		layout = append(layout, strings.SplitN(s.Description, ":", 2)[0])
+	}
+	sort.Strings(layout)
+	return layout
+}
+
+// auditConfig compares the collected client configuration to the desired state
+func auditConfig(desired *DesiredState, data Metrics) []Drift {
+	var drifts []Drift
+	if desired.User != "" {
+		drifts = append(drifts, newDrift("user", desired.User, data.Options.User))
+	}
+	if desired.Team != "" {
+		drifts = append(drifts, newDrift("team", desired.Team, data.Options.Team))
+	}
+	if desired.PasskeySet != nil {
+		// The passkey itself is never reported
+		drifts = append(drifts, newDrift("passkey_set", strconv.FormatBool(*desired.PasskeySet), strconv.FormatBool(data.Options.Passkey != "")))
+	}
+	if desired.Power != "" {
+		drifts = append(drifts, newDrift("power", desired.Power, data.Options.Power))
+	}
+	if desired.Cause != "" {
+		drifts = append(drifts, newDrift("cause", desired.Cause, data.Options.Cause))
+		// Slots can override the client cause, slots left at the default ANY follow it
+		for _, s := range data.Slots {
+			o, ok := data.SlotOptions[s.ID]
+			if !ok || o.Cause == "" || strings.EqualFold(o.Cause, "ANY") {
+				continue
+			}
+			d := newDrift("cause", desired.Cause, o.Cause)
+			d.Slot = s.ID
+			drifts = append(drifts, d)
+		}
+	}
+	if len(desired.Slots) > 0 {
+		want := append([]string(nil), desired.Slots...)
+		sort.Strings(want)
+		drifts = append(drifts, newDrift("slots", strings.Join(want, ","), strings.Join(slotLayout(data.Slots), ",")))
+	}
+	return drifts
+}
+
+// remediate pushes the desired value of drifted options back to the client, slot options
+// are set with slot-options
+func remediate(client *Client, drifts []Drift) {
+	options := make(map[string]string)
+	slotOptions := make(map[string]map[string]string)
+	for _, d := range drifts {
+		name, ok := remediable[d.Setting]
+		if !ok || !d.Drift {
+			continue
+		}
+		if d.Slot == "" {
+			options[name] = d.Desired
+			continue
+		}
+		if slotOptions[d.Slot] == nil {
+			slotOptions[d.Slot] = make(map[string]string)
+		}
+		slotOptions[d.Slot][name] = d.Desired
+	}
+	if len(options) > 0 {
+		log.Infof("Remediating %d options on client %s", len(options), client.Name)
+		if _, err := client.SetOptions(options); err != nil {
+			log.Errorf("Cannot remediate client %s: %v", client.Name, err)
+		}
+	}
+	for slot, o := range slotOptions {
+		log.Infof("Remediating %d options on client %s slot %s", len(o), client.Name, slot)
+		if _, err := client.SetSlotOptions(slot, o); err != nil {
+			log.Errorf("Cannot remediate client %s slot %s: %v", client.Name, slot, err)
+		}
+	}
+}
+
+// remediateClients audits the clients each interval and remediates drifted options,
+// scrapes only report drift so they never change the clients
+func remediateClients(set *ClientSet, desired *DesiredState, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		<-ticker.C
+		for _, c := range set.All() {
+			s := c.rawSnapshot(interval)
+			if s.Error != nil {
+				continue
+			}
+			remediate(c, auditConfig(desired, s.Data))
+		}
+	}
+}
+
+// driftHandler serves the drift report of all clients, using data collected at most maxAge ago
+func driftHandler(set *ClientSet, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if config.Desired == nil {
+			writeJSONError(w, http.StatusNotFound, "no desired state configured")
+			return
+		}
+		clients := set.All()
+		report := make([]ClientDrift, 0, len(clients))
+		for _, c := range clients {
+			cd := ClientDrift{Client: c.Name, Settings: []Drift{}}
+			s := c.rawSnapshot(maxAge)
+			if s.Error != nil {
+				cd.Error = privacy.Scrub(s.Error.Error())
+			} else {
+				cd.Settings = auditConfig(config.Desired, s.Data)
+				for i := range cd.Settings {
+					d := &cd.Settings[i]
+					d.Desired = privacy.Apply(d.Setting, d.Desired)
+					d.Actual = privacy.Apply(d.Setting, d.Actual)
+				}
+			}
+			report = append(report, cd)
+		}
+		writeJSON(w, http.StatusOK, report)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+)
+
+func TestAuditConfig(t *testing.T) {
+	yes := true
+	data := Metrics{
+		Options: Options{User: "Anonymous", Team: "0", Power: "full", Cause: "ANY", Passkey: "0123"},
+		Slots: []SlotInfo{
+			{ID: "00", Description: "cpu:22"},
+			{ID: "01", Description: "gpu:0:GP102"},
+			{ID: "02", Description: "gpu:1:TU104"},
+		},
+		SlotOptions: map[string]SlotOptions{
+			"00": {Cause: "ANY"},
+			"01": {Cause: "CANCER"},
+			// No cause in the reply
+			"02": {},
+		},
+	}
+	for _, tc := range []struct {
+		name    string
+		desired DesiredState
+		want    []Drift
+	}{
+		{"nothing desired", DesiredState{}, nil},
+		{"client options", DesiredState{User: "anonymous", Team: "1", Power: "FULL", PasskeySet: &yes}, []Drift{
+			{Setting: "user", Desired: "anonymous", Actual: "Anonymous"},
+			{Setting: "team", Desired: "1", Actual: "0", Drift: true},
+			{Setting: "passkey_set", Desired: "true", Actual: "true"},
+			{Setting: "power", Desired: "FULL", Actual: "full"},
+		}},
+		// Slots at the default cause follow the client, only the slot overriding it is compared
+		{"slot cause", DesiredState{Cause: "cancer"}, []Drift{
+			{Setting: "cause", Desired: "cancer", Actual: "ANY", Drift: true},
+			{Setting: "cause", Slot: "01", Desired: "cancer", Actual: "CANCER"},
+		}},
+		{"default cause", DesiredState{Cause: "any"}, []Drift{
+			{Setting: "cause", Desired: "any", Actual: "ANY"},
+			{Setting: "cause", Slot: "01", Desired: "any", Actual: "CANCER", Drift: true},
+		}},
+		{"slot layout", DesiredState{Slots: []string{"gpu", "cpu"}}, []Drift{
+			{Setting: "slots", Desired: "cpu,gpu", Actual: "cpu,gpu,gpu", Drift: true},
+		}},
+	} {
+		if got := auditConfig(&tc.desired, data); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// optionsServer applies options commands to its options and replies with them, options
+// in stuck keep their value
+func optionsServer(t *testing.T, stuck ...string) (*fahtest.Server, map[string]map[string]string) {
+	srv := newTestServer(t)
+	var mutex sync.Mutex
+	options := map[string]map[string]string{
+		"":   {"cause": "ANY", "power": "light", "user": "Anonymous"},
+		"01": {"cause": "ANY"},
+	}
+	set := func(target string, args []string) fahtest.Response {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for _, arg := range args {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) == 2 && !contains(stuck, kv[0]) {
+				options[target][kv[0]] = kv[1]
+			}
+		}
+		return fahtest.Response{Name: "options", Payload: fahtest.MustPyON(options[target])}
+	}
+	srv.HandleFunc("options", func(args []string) fahtest.Response { return set("", args) })
+	srv.HandleFunc("slot-options", func(args []string) fahtest.Response { return set(args[0], args[1:]) })
+	return srv, options
+}
+
+func contains(values []string, v string) bool {
+	for _, x := range values {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRemediate(t *testing.T) {
+	srv, options := optionsServer(t)
+	c := NewClient(ClientConfig{Name: "remediate", Address: srv.Addr()})
+	remediate(c, []Drift{
+		{Setting: "power", Desired: "full", Actual: "light", Drift: true},
+		{Setting: "cause", Desired: "cancer", Actual: "ANY", Drift: true},
+		{Setting: "cause", Slot: "01", Desired: "cancer", Actual: "ANY", Drift: true},
+		// Not drifted, or not remediable
+		{Setting: "user", Desired: "Anonymous", Actual: "Anonymous"},
+		{Setting: "slots", Desired: "cpu", Actual: "gpu", Drift: true},
+	})
+	commands := srv.Commands()
+	sort.Strings(commands)
+	want := []string{"options cause=cancer power=full", "slot-options 01 cause=cancer"}
+	if !reflect.DeepEqual(commands, want) {
+		t.Errorf("sent %q, want %q", commands, want)
+	}
+	if options[""]["power"] != "full" || options[""]["cause"] != "cancer" || options["01"]["cause"] != "cancer" {
+		t.Errorf("options not remediated: %v", options)
+	}
+}
+
+func TestSetOptionsVerification(t *testing.T) {
+	srv, _ := optionsServer(t, "power", "cause")
+	c := NewClient(ClientConfig{Name: "verify", Address: srv.Addr()})
+	// Values are compared case insensitively
+	if _, err := c.SetOptions(map[string]string{"user": "anonymous"}); err != nil {
+		t.Errorf("SetOptions: %v", err)
+	}
+	// Options the client did not apply are errors
+	if _, err := c.SetOptions(map[string]string{"power": "full"}); err == nil || err.Error() != "option power is light after setting it to full" {
+		t.Errorf("SetOptions of a stuck option: %v", err)
+	}
+	if _, err := c.SetSlotOptions("01", map[string]string{"cause": "cancer"}); err == nil || err.Error() != "option cause is ANY after setting it to cancer" {
+		t.Errorf("SetSlotOptions of a stuck option: %v", err)
+	}
+	if _, err := c.SetSlotOptions("01 02", map[string]string{"cause": "cancer"}); err == nil {
+		t.Error("SetSlotOptions accepted an invalid slot")
+	}
+}
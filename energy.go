@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// energy accounts the energy, cost and emissions of the power sources, nil when disabled
+var energy *EnergyAccount
+
+// EnergyConfig configures electricity tariffs and carbon intensity
+type EnergyConfig struct {
+	// Currency of the prices, required for cost metrics
+	Currency string `yaml:"currency"`
+	// Price per kWh outside of the schedule
+	Price float64 `yaml:"price"`
+	// Schedule of time-of-use prices, the first matching period applies
+	Schedule []TariffPeriod `yaml:"schedule"`
+	// Timezone of the schedule, local time by default
+	Timezone string `yaml:"timezone"`
+	// CarbonIntensity of the grid in grams of CO2 per kWh
+	CarbonIntensity float64 `yaml:"carbon_intensity"`
+	// StateFile keeps the counters across restarts
+	StateFile string `yaml:"state_file"`
+	// MaxGap between scrapes which is still accounted, longer gaps are skipped
+	MaxGap time.Duration `yaml:"max_gap"`
+}
+
+// TariffPeriod is a time-of-use price, End before Start spans midnight
+type TariffPeriod struct {
+	// Days such as mon or sat, every day when empty
+	Days  []string `yaml:"days"`
+	Start string   `yaml:"start"`
+	End   string   `yaml:"end"`
+	Price float64  `yaml:"price"`
+
+	days       map[time.Weekday]bool
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// energyTotals are the accumulated values of a slot, or of the host when the slot is empty
+type energyTotals struct {
+	Joules float64 `json:"joules"`
+	Cost   float64 `json:"cost"`
+	CO2    float64 `json:"co2_grams"`
+}
+
+// energyState is the state file, costs are in Currency
+type energyState struct {
+	Currency string                              `json:"currency"`
+	Totals   map[string]map[string]*energyTotals `json:"totals"`
+}
+
+// powerSample is the previous power of a slot
+type powerSample struct {
+	watts float64
+	time  time.Time
+}
+
+// EnergyAccount integrates the power of every client and slot over time
+type EnergyAccount struct {
+	cfg      EnergyConfig
+	location *time.Location
+
+	mutex sync.Mutex
+	// Totals and previous samples by client and slot
+	totals  map[string]map[string]*energyTotals
+	samples map[string]map[string]powerSample
+	saved   time.Time
+}
+
+// NewEnergyAccount validates the configuration and restores the counters from the state file
+func NewEnergyAccount(cfg EnergyConfig) (*EnergyAccount, error) {
+	if (cfg.Price > 0 || len(cfg.Schedule) > 0) && cfg.Currency == "" {
+		return nil, fmt.Errorf("energy prices require a currency")
+	}
+	if cfg.MaxGap == 0 {
+		cfg.MaxGap = 10 * time.Minute
+	}
+	a := &EnergyAccount{
+		cfg:      cfg,
+		location: time.Local,
+		totals:   make(map[string]map[string]*energyTotals),
+		samples:  make(map[string]map[string]powerSample),
+	}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		a.location = loc
+	}
+	for i := range cfg.Schedule {
+		p := &cfg.Schedule[i]
+		var err error
+		if p.start, err = parseClock(p.Start); err != nil {
+			return nil, fmt.Errorf("tariff period %d: %w", i, err)
+		}
+		if p.end, err = parseClock(p.End); err != nil {
+			return nil, fmt.Errorf("tariff period %d: %w", i, err)
+		}
+		p.days = make(map[time.Weekday]bool, len(p.Days))
+		for _, d := range p.Days {
+			key := strings.ToLower(d)
+			if len(key) > 3 {
+				key = key[:3]
+			}
+			wd, ok := weekdays[key]
+			if !ok {
+				return nil, fmt.Errorf("tariff period %d: unknown day %q", i, d)
+			}
+			p.days[wd] = true
+		}
+	}
+	if cfg.StateFile != "" {
+		b, err := os.ReadFile(cfg.StateFile)
+		if err == nil {
+			err = a.restore(b)
+		} else if errors.Is(err, os.ErrNotExist) {
+			err = nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot restore energy counters: %w", err)
+		}
+	}
+	return a, nil
+}
+
+// restore loads the totals of the state file, costs are reset when the currency changed
+// since they cannot be added to costs in another currency
+func (a *EnergyAccount) restore(b []byte) error {
+	var state energyState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return err
+	}
+	if state.Totals != nil {
+		a.totals = state.Totals
+	}
+	if state.Currency != a.cfg.Currency {
+		log.Infof("Energy currency changed from %q to %q, resetting costs", state.Currency, a.cfg.Currency)
+		for _, slots := range a.totals {
+			for _, t := range slots {
+				t.Cost = 0
+			}
+		}
+	}
+	return nil
+}
+
+// parseClock returns the minutes since midnight of a HH:MM time
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, use HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Price returns the price per kWh at a time
+func (a *EnergyAccount) Price(t time.Time) float64 {
+	t = t.In(a.location)
+	minute := t.Hour()*60 + t.Minute()
+	for _, p := range a.cfg.Schedule {
+		if len(p.days) > 0 && !p.days[t.Weekday()] {
+			continue
+		}
+		var in bool
+		if p.start <= p.end {
+			in = minute >= p.start && minute < p.end
+		} else {
+			in = minute >= p.start || minute < p.end
+		}
+		if in {
+			return p.Price
+		}
+	}
+	return a.cfg.Price
+}
+
+// Currency returns the currency of the costs, empty when no prices are configured
+func (a *EnergyAccount) Currency() string {
+	return a.cfg.Currency
+}
+
+// Carbon returns whether a carbon intensity is configured
+func (a *EnergyAccount) Carbon() bool {
+	return a.cfg.CarbonIntensity > 0
+}
+
+// Record accumulates the power of the slots of a client since the previous call and returns the totals,
+// the energy of an interval is the average of its two samples
+func (a *EnergyAccount) Record(client string, watts map[string]float64, now time.Time) map[string]energyTotals {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.totals[client] == nil {
+		a.totals[client] = make(map[string]*energyTotals)
+	}
+	if a.samples[client] == nil {
+		a.samples[client] = make(map[string]powerSample)
+	}
+	price := a.Price(now)
+	for slot, w := range watts {
+		t := a.totals[client][slot]
+		if t == nil {
+			t = &energyTotals{}
+			a.totals[client][slot] = t
+		}
+		prev, ok := a.samples[client][slot]
+		a.samples[client][slot] = powerSample{watts: w, time: now}
+		elapsed := now.Sub(prev.time)
+		if !ok || elapsed <= 0 || elapsed > a.cfg.MaxGap {
+			continue
+		}
+		joules := (prev.watts + w) / 2 * elapsed.Seconds()
+		kwh := joules / 3.6e6
+		t.Joules += joules
+		t.Cost += kwh * price
+		t.CO2 += kwh * a.cfg.CarbonIntensity
+	}
+	totals := make(map[string]energyTotals, len(a.totals[client]))
+	for slot, t := range a.totals[client] {
+		totals[slot] = *t
+	}
+	if a.cfg.StateFile != "" && now.Sub(a.saved) >= time.Minute {
+		if err := a.save(); err != nil {
+			log.Errorf("Cannot save energy counters: %v", err)
+		}
+		a.saved = now
+	}
+	return totals
+}
+
+// Save writes the totals to the state file, if any, so no energy is lost on exit
+func (a *EnergyAccount) Save() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.cfg.StateFile == "" {
+		return nil
+	}
+	return a.save()
+}
+
+// save writes the totals to the state file, the caller must hold the lock
+func (a *EnergyAccount) save() error {
+	b, err := json.Marshal(energyState{Currency: a.cfg.Currency, Totals: a.totals})
+	if err != nil {
+		return err
+	}
+	tmp := a.cfg.StateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.cfg.StateFile)
+}
+
+// creditPerCurrency returns the points earned per currency unit at the current power and price
+func creditPerCurrency(ppd float64, watts float64, price float64) (float64, bool) {
+	costPerDay := watts / 1000 * 24 * price
+	if costPerDay <= 0 {
+		return 0, false
+	}
+	return ppd / costPerDay, true
+}
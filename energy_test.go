@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEnergyPrice(t *testing.T) {
+	a, err := NewEnergyAccount(EnergyConfig{
+		Currency: "EUR",
+		Price:    0.2,
+		Timezone: "UTC",
+		Schedule: []TariffPeriod{
+			{Days: []string{"monday", "tue", "wed", "thu", "fri"}, Start: "17:00", End: "21:00", Price: 0.5},
+			{Start: "22:00", End: "06:00", Price: 0.1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2023-10-02 is a Monday
+	day := func(d int, clock string) time.Time {
+		minutes, err := parseClock(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return time.Date(2023, 10, d, minutes/60, minutes%60, 0, 0, time.UTC)
+	}
+	cases := []struct {
+		name  string
+		time  time.Time
+		price float64
+	}{
+		{"weekday peak", day(2, "18:30"), 0.5},
+		{"peak start", day(2, "17:00"), 0.5},
+		{"peak end is exclusive", day(2, "21:00"), 0.2},
+		{"weekend has no peak", day(7, "18:30"), 0.2},
+		{"night before midnight", day(2, "23:15"), 0.1},
+		{"night after midnight", day(3, "02:00"), 0.1},
+		{"night start", day(2, "22:00"), 0.1},
+		{"night end is exclusive", day(3, "06:00"), 0.2},
+		{"weekend night", day(8, "05:59"), 0.1},
+		{"other time zone", day(2, "18:30").In(time.FixedZone("UTC+2", 2*3600)), 0.5},
+	}
+	for _, c := range cases {
+		if p := a.Price(c.time); p != c.price {
+			t.Errorf("%s: got %v, want %v", c.name, p, c.price)
+		}
+	}
+}
+
+func TestEnergyRecord(t *testing.T) {
+	a, err := NewEnergyAccount(EnergyConfig{Currency: "EUR", Price: 0.36, CarbonIntensity: 100, MaxGap: 10 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		offset time.Duration
+		watts  float64
+		joules float64
+	}{
+		{"first sample", 0, 100, 0},
+		{"average of both samples", time.Minute, 200, 150 * 60},
+		{"gap longer than max_gap", 21 * time.Minute, 200, 150 * 60},
+		{"after the gap", 22 * time.Minute, 200, 150*60 + 200*60},
+		{"same time", 22 * time.Minute, 300, 150*60 + 200*60},
+		{"clock went back", 20 * time.Minute, 300, 150*60 + 200*60},
+		{"gap of max_gap", 30 * time.Minute, 300, 150*60 + 200*60 + 300*600},
+	}
+	for _, c := range cases {
+		totals := a.Record("host", map[string]float64{"": c.watts}, start.Add(c.offset))
+		got := totals[""]
+		kwh := c.joules / 3.6e6
+		if math.Abs(got.Joules-c.joules) > 1e-6 || math.Abs(got.Cost-kwh*0.36) > 1e-9 || math.Abs(got.CO2-kwh*100) > 1e-9 {
+			t.Errorf("%s: got %+v, want %v J", c.name, got, c.joules)
+		}
+	}
+}
+
+func TestEnergyState(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "energy.json")
+	start := time.Date(2023, 10, 2, 12, 0, 0, 0, time.UTC)
+	record := func(currency string) energyTotals {
+		a, err := NewEnergyAccount(EnergyConfig{Currency: currency, Price: 0.36, StateFile: file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Record("host", map[string]float64{"": 100}, start)
+		totals := a.Record("host", map[string]float64{"": 100}, start.Add(time.Minute))
+		if err := a.Save(); err != nil {
+			t.Fatal(err)
+		}
+		return totals[""]
+	}
+
+	if got := record("EUR"); got.Joules != 6000 {
+		t.Fatalf("got %+v, want 6000 J", got)
+	}
+	// Restored with the same currency
+	if got := record("EUR"); got.Joules != 12000 || math.Abs(got.Cost-12000e-7) > 1e-12 {
+		t.Errorf("got %+v, want 12000 J costing 0.0012", got)
+	}
+	// The costs of another currency are reset, the energy is kept
+	if got := record("NOK"); got.Joules != 18000 || math.Abs(got.Cost-6000e-7) > 1e-12 {
+		t.Errorf("got %+v, want 18000 J costing 0.0006", got)
+	}
+}
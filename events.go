@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+// Event types
+const (
+	EventSlotStateChanged   = "slot_state_changed"
+	EventUnitAssigned       = "unit_assigned"
+	EventUnitFinished       = "unit_finished"
+	EventUnitFailed         = "unit_failed"
+	EventUnitMissedTimeout  = "unit_missed_timeout"
+	EventClientDisconnected = "client_disconnected"
+	EventClientConnected    = "client_connected"
+	EventConfigChanged      = "config_changed"
+	EventDonorCreditChanged = "donor_credit_changed"
+)
+
+var (
+	// events receives the events of every client collection, nil when disabled
+	events *EventHub
+
+	eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_dropped_total",
+		Help:      "Events not delivered to slow subscribers",
+	})
+)
+
+// Event is a change between two successive snapshots of a client
+type Event struct {
+	ID      uint64    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Slot    string    `json:"slot,omitempty"`
+	Queue   string    `json:"queue,omitempty"`
+	Unit    string    `json:"unit,omitempty"`
+	From    string    `json:"from,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Message string    `json:"message"`
+}
+
+// EventHub keeps recent events and fans them out to subscribers
+type EventHub struct {
+	mutex       sync.Mutex
+	nextID      uint64
+	history     []Event
+	size        int
+	subscribers map[chan Event]struct{}
+}
+
+// NewEventHub creates a hub keeping the last size events for resuming
+func NewEventHub(size int) *EventHub {
+	return &EventHub{
+		nextID:      1,
+		size:        size,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish assigns an ID to the event and sends it to all subscribers,
+// slow subscribers miss events rather than blocking collection
+func (h *EventHub) Publish(e Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	e.ID = h.nextID
+	e.Message = privacy.Scrub(e.Message)
+	h.nextID++
+	h.history = append(h.history, e)
+	if len(h.history) > h.size {
+		h.history = h.history[len(h.history)-h.size:]
+	}
+	log.Debugf("Event %d %s: %s", e.ID, e.Type, e.Message)
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			eventsDropped.Inc()
+			log.Warnf("Dropped event %d for a slow subscriber", e.ID)
+		}
+	}
+}
+
+// Subscribe returns the kept events after lastID and a channel receiving new events
+func (h *EventHub) Subscribe(lastID uint64) ([]Event, chan Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var backlog []Event
+	for _, e := range h.history {
+		if e.ID > lastID {
+			backlog = append(backlog, e)
+		}
+	}
+	ch := make(chan Event, 64)
+	h.subscribers[ch] = struct{}{}
+	return backlog, ch
+}
+
+// Unsubscribe stops sending events to ch
+func (h *EventHub) Unsubscribe(ch chan Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// unitKey identifies a work unit across snapshots
+func unitKey(q QueueInfo) string {
+	return fmt.Sprintf("%d:%d:%d:%d", q.Project, q.Run, q.Clone, q.Gen)
+}
+
+// queueKey identifies a queue entry, which holds a unit once it is assigned
+func queueKey(q QueueInfo) string {
+	return q.Slot + "/" + q.ID
+}
+
+// unitAssigned returns whether the entry has a unit, entries still downloading report 0:0:0:0
+func unitAssigned(q QueueInfo) bool {
+	return q.Project != 0 || q.Run != 0 || q.Clone != 0 || q.Gen != 0
+}
+
+// unitFinished guesses whether a unit which left the queue was completed
+func unitFinished(q QueueInfo) bool {
+	return q.State == "SEND" || q.State == "FINISHED" || (q.TotalFrames > 0 && q.FramesDone >= q.TotalFrames)
+}
+
+// diffSnapshots derives the events between two successive snapshots of a client
+func diffSnapshots(client string, prev Snapshot, cur Snapshot) []Event {
+	var out []Event
+	add := func(e Event) {
+		e.Time = cur.Time
+		e.Client = client
+		out = append(out, e)
+	}
+	switch {
+	case (prev.Time.IsZero() || prev.Error == nil) && cur.Error != nil:
+		// Also reported on the first collection, for clients which are down from the start
+		add(Event{Type: EventClientDisconnected, Message: fmt.Sprintf("client %s disconnected: %v", client, cur.Error)})
+		return out
+	case prev.Time.IsZero():
+		// Nothing to compare against on the first collection
+		return out
+	case prev.Error != nil && cur.Error == nil:
+		add(Event{Type: EventClientConnected, Message: fmt.Sprintf("client %s connected", client)})
+		// Changes while disconnected are unknown
+		return out
+	case cur.Error != nil:
+		return out
+	}
+
+	prevSlots := make(map[string]SlotInfo, len(prev.Data.Slots))
+	for _, s := range prev.Data.Slots {
+		prevSlots[s.ID] = s
+	}
+	for _, s := range cur.Data.Slots {
+		if p, ok := prevSlots[s.ID]; !ok || p.Status != s.Status {
+			add(Event{Type: EventSlotStateChanged, Slot: s.ID, From: p.Status, To: s.Status,
+				Message: fmt.Sprintf("slot %s on %s changed from %s to %s", s.ID, client, p.Status, s.Status)})
+		}
+	}
+
+	// Units are tracked by queue entry, a unit is assigned once its entry has a PRCG
+	prevUnits := make(map[string]QueueInfo, len(prev.Data.Queues))
+	for _, q := range prev.Data.Queues {
+		if unitAssigned(q) {
+			prevUnits[queueKey(q)] = q
+		}
+	}
+	curUnits := make(map[string]QueueInfo, len(cur.Data.Queues))
+	for _, q := range cur.Data.Queues {
+		if !unitAssigned(q) {
+			continue
+		}
+		key := unitKey(q)
+		curUnits[queueKey(q)] = q
+		p, ok := prevUnits[queueKey(q)]
+		if !ok || unitKey(p) != key {
+			add(Event{Type: EventUnitAssigned, Slot: q.Slot, Queue: q.ID, Unit: key,
+				Message: fmt.Sprintf("unit %s assigned to slot %s on %s", key, q.Slot, client)})
+			continue
+		}
+		if p.Error == "NO_ERROR" && q.Error != "NO_ERROR" {
+			add(Event{Type: EventUnitFailed, Slot: q.Slot, Queue: q.ID, Unit: key, From: p.Error, To: q.Error,
+				Message: fmt.Sprintf("unit %s on slot %s of %s failed: %s", key, q.Slot, client, q.Error)})
+		}
+		if timeout, err := time.Parse(time.RFC3339, q.Timeout); err == nil && !unitFinished(q) &&
+			prev.Time.Before(timeout) && !cur.Time.Before(timeout) {
+			add(Event{Type: EventUnitMissedTimeout, Slot: q.Slot, Queue: q.ID, Unit: key,
+				Message: fmt.Sprintf("unit %s on slot %s of %s missed its timeout", key, q.Slot, client)})
+		}
+	}
+	for entry, q := range prevUnits {
+		if c, ok := curUnits[entry]; ok && unitKey(c) == unitKey(q) {
+			continue
+		}
+		key := unitKey(q)
+		if unitFinished(q) {
+			add(Event{Type: EventUnitFinished, Slot: q.Slot, Queue: q.ID, Unit: key,
+				Message: fmt.Sprintf("unit %s on slot %s of %s finished", key, q.Slot, client)})
+		} else {
+			add(Event{Type: EventUnitFailed, Slot: q.Slot, Queue: q.ID, Unit: key, From: q.State,
+				Message: fmt.Sprintf("unit %s on slot %s of %s was removed while %s", key, q.Slot, client, q.State)})
+		}
+	}
+
+	if prev.Data.Donor.Credit != cur.Data.Donor.Credit && prev.Data.Donor.Name != "" {
+		add(Event{Type: EventDonorCreditChanged, From: strconv.Itoa(prev.Data.Donor.Credit), To: strconv.Itoa(cur.Data.Donor.Credit),
+			Message: fmt.Sprintf("donor %s credit changed to %d", cur.Data.Donor.Name, cur.Data.Donor.Credit)})
+	}
+
+	if !reflect.DeepEqual(prev.Data.Options, cur.Data.Options) || !reflect.DeepEqual(prev.Data.SlotOptions, cur.Data.SlotOptions) {
+		add(Event{Type: EventConfigChanged, Message: fmt.Sprintf("configuration of %s changed", client)})
+	}
+	return out
+}
+
+// eventsHandler streams events using Server-Sent Events, clients can resume with the
+// Last-Event-ID header or the last_event_id query parameter
+func eventsHandler(hub *EventHub) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		lastID := r.Header.Get("Last-Event-ID")
+		if lastID == "" {
+			lastID = r.URL.Query().Get("last_event_id")
+		}
+		var resume uint64
+		if lastID != "" {
+			var err error
+			resume, err = strconv.ParseUint(lastID, 10, 64)
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid last event ID")
+				return
+			}
+		}
+		backlog, ch := hub.Subscribe(resume)
+		defer hub.Unsubscribe(ch)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		send := func(e Event) bool {
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Errorf("Cannot encode event: %v", err)
+				return true
+			}
+			_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data)
+			flusher.Flush()
+			return err == nil
+		}
+		// Events published while sending the backlog are in both, skip them
+		var sent uint64 = resume
+		for _, e := range backlog {
+			if !send(e) {
+				return
+			}
+			sent = e.ID
+		}
+		flusher.Flush()
+		heartbeat := time.NewTicker(15 * time.Second)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case e := <-ch:
+				if e.ID <= sent {
+					continue
+				}
+				if !send(e) {
+					return
+				}
+				sent = e.ID
+			case <-heartbeat.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDiffSnapshotsConnection(t *testing.T) {
+	now := time.Now()
+	up := Snapshot{Time: now}
+	down := Snapshot{Time: now, Error: errors.New("connection refused")}
+	for _, tc := range []struct {
+		name      string
+		prev, cur Snapshot
+		want      []string
+	}{
+		{"first up", Snapshot{}, up, nil},
+		{"first down", Snapshot{}, down, []string{EventClientDisconnected}},
+		{"disconnected", up, down, []string{EventClientDisconnected}},
+		{"still down", down, down, nil},
+		{"connected", down, up, []string{EventClientConnected}},
+	} {
+		var got []string
+		for _, e := range diffSnapshots("test", tc.prev, tc.cur) {
+			got = append(got, e.Type)
+		}
+		if len(got) != len(tc.want) || (len(got) > 0 && got[0] != tc.want[0]) {
+			t.Errorf("%s: got events %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestEventHubDrops(t *testing.T) {
+	hub := NewEventHub(10)
+	_, ch := hub.Subscribe(0)
+	defer hub.Unsubscribe(ch)
+	before := testutil.ToFloat64(eventsDropped)
+	for i := 0; i < cap(ch)+3; i++ {
+		hub.Publish(Event{Type: EventConfigChanged})
+	}
+	if dropped := testutil.ToFloat64(eventsDropped) - before; dropped != 3 {
+		t.Errorf("dropped %v events, want 3", dropped)
+	}
+	// The kept history is still available for resuming
+	backlog, ch2 := hub.Subscribe(0)
+	defer hub.Unsubscribe(ch2)
+	if len(backlog) != 10 {
+		t.Errorf("backlog has %d events, want 10", len(backlog))
+	}
+}
+
+func TestDiffSnapshotsUnits(t *testing.T) {
+	now := time.Now()
+	download := func(slot string) QueueInfo {
+		return QueueInfo{ID: "01", Slot: slot, State: "DOWNLOAD", Error: "NO_ERROR"}
+	}
+	running := func(slot string, project int) QueueInfo {
+		return QueueInfo{ID: "01", Slot: slot, State: "RUNNING", Error: "NO_ERROR", Project: project, Run: 1, Clone: 2, Gen: 3}
+	}
+	snapshot := func(queues ...QueueInfo) Snapshot {
+		return Snapshot{Time: now, Data: Metrics{Queues: queues}}
+	}
+	for _, tc := range []struct {
+		name      string
+		prev, cur Snapshot
+		want      []string
+	}{
+		{"downloads in two slots", snapshot(), snapshot(download("00"), download("01")), nil},
+		{"downloads finished", snapshot(download("00"), download("01")), snapshot(running("00", 100), running("01", 200)),
+			[]string{EventUnitAssigned + " 00 100:1:2:3", EventUnitAssigned + " 01 200:1:2:3"}},
+		{"still running", snapshot(running("00", 100)), snapshot(running("00", 100)), nil},
+		{"finished and next downloading", snapshot(func() QueueInfo { q := running("00", 100); q.State = "SEND"; return q }()),
+			snapshot(download("00")), []string{EventUnitFinished + " 00 100:1:2:3"}},
+		{"removed while running", snapshot(running("00", 100)), snapshot(), []string{EventUnitFailed + " 00 100:1:2:3"}},
+		{"entry reused by another unit", snapshot(running("00", 100)), snapshot(running("00", 300)),
+			[]string{EventUnitAssigned + " 00 300:1:2:3", EventUnitFailed + " 00 100:1:2:3"}},
+	} {
+		var got []string
+		for _, e := range diffSnapshots("test", tc.prev, tc.cur) {
+			got = append(got, e.Type+" "+e.Slot+" "+e.Unit)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got events %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
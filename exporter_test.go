@@ -0,0 +1,239 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestRegistry registers an exporter of the client at address in a new registry
+func newTestRegistry(t *testing.T, cc ClientConfig) *prometheus.Registry {
+	t.Helper()
+	if cc.Name == "" {
+		cc.Name = cc.Address
+	}
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewExporter(NewClient(cc)))
+	return reg
+}
+
+// newTestServer starts a fake client with the sample data, closed when the test ends
+func newTestServer(t *testing.T) *fahtest.Server {
+	t.Helper()
+	srv := fahtest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	return srv
+}
+
+func assertMetrics(t *testing.T, reg prometheus.Gatherer, expected string, names ...string) {
+	t.Helper()
+	if err := testutil.GatherAndCompare(reg, strings.NewReader(expected), names...); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExporterSample(t *testing.T) {
+	srv := newTestServer(t)
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	assertMetrics(t, reg, `
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up 1
+# HELP fah_slot_count Count of folding slots
+# TYPE fah_slot_count gauge
+fah_slot_count 1
+# HELP fah_options Client options
+# TYPE fah_options gauge
+fah_options{power="full",team="0",user="Anonymous"} 1
+# HELP fah_description Folding slot description
+# TYPE fah_description gauge
+fah_description{description="gpu:0:GP102 [GeForce GTX 1080 Ti] 11380",slot="01"} 1
+# HELP fah_paused Whether slot is paused
+# TYPE fah_paused gauge
+fah_paused{reason="",slot="01"} 0
+# HELP fah_ppd Task points per day
+# TYPE fah_ppd gauge
+fah_ppd{queue="01",slot="01"} 1.683157e+06
+# HELP fah_percent_done Task percent done
+# TYPE fah_percent_done gauge
+fah_percent_done{queue="01",slot="01"} 16.53
+# HELP fah_frames_done Task frames done
+# TYPE fah_frames_done gauge
+fah_frames_done{queue="01",slot="01"} 16
+# HELP fah_queue_info Task state, ETA and eventual error
+# TYPE fah_queue_info gauge
+fah_queue_info{error="NO_ERROR",eta="2 hours 03 mins",queue="01",slot="01",state="RUNNING"} 1
+# HELP fah_slot_options_info Folding slot configuration
+# TYPE fah_slot_options_info gauge
+fah_slot_options_info{cause="ANY",client_subtype="LINUX",client_type="normal",core_priority="idle",gpu_index="0",max_packet_size="normal",slot="01"} 1
+# HELP fah_slot_status Folding slot status, one series per known status
+# TYPE fah_slot_status gauge
+fah_slot_status{slot="01",status="DISABLED"} 0
+fah_slot_status{slot="01",status="FAILED"} 0
+fah_slot_status{slot="01",status="FINISHING"} 0
+fah_slot_status{slot="01",status="PAUSED"} 0
+fah_slot_status{slot="01",status="READY"} 0
+fah_slot_status{slot="01",status="RUNNING"} 1
+fah_slot_status{slot="01",status="STOPPING"} 0
+fah_slot_status{slot="01",status="UPDATING"} 0
+`, "fah_up", "fah_slot_count", "fah_options", "fah_description", "fah_paused", "fah_ppd", "fah_percent_done",
+		"fah_frames_done", "fah_queue_info", "fah_slot_options_info", "fah_slot_status")
+}
+
+func TestExporterPausedSlot(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("slot-info", fahtest.Response{Name: "slots", Payload: fahtest.MustPyON([]map[string]interface{}{{
+		"id":          "01",
+		"status":      "PAUSED",
+		"description": "cpu:12",
+		"options":     map[string]interface{}{"paused": true},
+		"reason":      "by user",
+		"idle":        false,
+	}})})
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	assertMetrics(t, reg, `
+# HELP fah_paused Whether slot is paused
+# TYPE fah_paused gauge
+fah_paused{reason="by user",slot="01"} 1
+# HELP fah_slot_status Folding slot status, one series per known status
+# TYPE fah_slot_status gauge
+fah_slot_status{slot="01",status="DISABLED"} 0
+fah_slot_status{slot="01",status="FAILED"} 0
+fah_slot_status{slot="01",status="FINISHING"} 0
+fah_slot_status{slot="01",status="PAUSED"} 1
+fah_slot_status{slot="01",status="READY"} 0
+fah_slot_status{slot="01",status="RUNNING"} 0
+fah_slot_status{slot="01",status="STOPPING"} 0
+fah_slot_status{slot="01",status="UPDATING"} 0
+`, "fah_paused", "fah_slot_status")
+}
+
+func TestExporterRemovedSlot(t *testing.T) {
+	srv := newTestServer(t)
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	if _, err := reg.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	srv.Handle("slot-info", fahtest.Response{Name: "slots", Payload: "[]"})
+	srv.Handle("queue-info", fahtest.Response{Name: "units", Payload: "[]"})
+	assertMetrics(t, reg, `
+# HELP fah_slot_count Count of folding slots
+# TYPE fah_slot_count gauge
+fah_slot_count 0
+`, "fah_slot_count", "fah_description", "fah_paused", "fah_ppd", "fah_slot_options_info", "fah_slot_status")
+}
+
+func TestExporterPassword(t *testing.T) {
+	srv := newTestServer(t)
+	srv.SetPassword("secret")
+	for _, tc := range []struct {
+		password string
+		up       string
+	}{
+		{"secret", "1"},
+		{"wrong", "0"},
+	} {
+		reg := newTestRegistry(t, ClientConfig{Address: srv.Addr(), Password: tc.password})
+		assertMetrics(t, reg, `
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up `+tc.up+"\n", "fah_up")
+	}
+}
+
+func TestExporterUnreachable(t *testing.T) {
+	srv := fahtest.NewServer()
+	address := srv.Addr()
+	srv.Close()
+	reg := newTestRegistry(t, ClientConfig{Address: address})
+	// Nothing but fah_up is exported
+	assertMetrics(t, reg, `
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up 0
+`)
+}
+
+func TestExporterDisconnect(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("slot-info", fahtest.Response{Disconnect: true})
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	assertMetrics(t, reg, `
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up 0
+`)
+}
+
+func TestExporterSlotOptionsError(t *testing.T) {
+	srv := newTestServer(t)
+	srv.Handle("slot-options", fahtest.Response{Error: "Slot 01 not found"})
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	// Slot options are optional, the rest of the client is still exported
+	assertMetrics(t, reg, `
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up 1
+# HELP fah_slot_count Count of folding slots
+# TYPE fah_slot_count gauge
+fah_slot_count 1
+`, "fah_up", "fah_slot_count", "fah_slot_options_info")
+}
+
+func TestExporterSchemaV2(t *testing.T) {
+	metricsSchema = schemaV2
+	defer func() { metricsSchema = schemaV1 }()
+	srv := newTestServer(t)
+	reg := newTestRegistry(t, ClientConfig{Address: srv.Addr()})
+	assertMetrics(t, reg, `
+# HELP fah_paused Whether slot is paused
+# TYPE fah_paused gauge
+fah_paused{slot="01"} 0
+# HELP fah_queue_info Task identity
+# TYPE fah_queue_info gauge
+fah_queue_info{clone="1",core="0x22",gen="2",project="13424",queue="01",run="0",slot="01",unit="0x0000000300000002000034700000001"} 1
+# HELP fah_queue_eta_seconds Task estimated time to completion
+# TYPE fah_queue_eta_seconds gauge
+fah_queue_eta_seconds{queue="01",slot="01"} 7380
+`, "fah_paused", "fah_queue_info", "fah_queue_eta_seconds")
+}
+
+// countingGatherer counts its gathers
+type countingGatherer struct {
+	gathers int
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.gathers++
+	return []*dto.MetricFamily{{Name: proto.String("fah_up")}, {Name: proto.String("go_goroutines")}}, nil
+}
+
+func TestSharedGatherer(t *testing.T) {
+	counting := &countingGatherer{}
+	g := newSharedGatherer(counting)
+	g.maxAge = time.Hour
+	for _, output := range []string{"InfluxDB", "remote write", "OTLP"} {
+		families := gatherFAH(g, output)
+		if len(families) != 1 || families[0].GetName() != "fah_up" {
+			t.Fatalf("%s got %v", output, families)
+		}
+	}
+	if counting.gathers != 1 {
+		t.Errorf("gathered %d times, want once", counting.gathers)
+	}
+	// gatherFAH must not filter the shared families in place
+	if families, _ := g.Gather(); len(families) != 2 {
+		t.Errorf("shared families were modified: %v", families)
+	}
+	g.maxAge = 0
+	gatherFAH(g, "Pushgateway")
+	if counting.gathers != 2 {
+		t.Errorf("gathered %d times after maxAge, want twice", counting.gathers)
+	}
+}
@@ -5,41 +5,69 @@ import (
 	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const fahAPI = "https://stats.foldingathome.org/api"
 
-// readPyON Send command to connection and read response
-// PyON is converted to JSON using text replacement
-func readPyON(conn net.Conn, command string) (outJSON string, err error) {
-
+// writeCommand sends a command to the FAH client without reading the response
+func writeCommand(conn net.Conn, command string) error {
 	p := []byte(command + "\r\n")
 	n, err := conn.Write(p)
 	if err != nil {
-		return
+		return err
 	}
 	if expected, actual := len(p), n; expected != actual {
-		err = fmt.Errorf("transmission problem: tried sending %d bytes, but actually only sent %d bytes", expected, actual)
+		return fmt.Errorf("transmission problem: tried sending %d bytes, but actually only sent %d bytes", expected, actual)
+	}
+	return nil
+}
+
+// readPyON Send command to connection and read response
+// PyON is converted to JSON using text replacement
+func readPyON(conn net.Conn, command string) (outJSON string, err error) {
+	err = writeCommand(conn, command)
+	if err != nil {
 		return
 	}
-	var rawOut string
-	var reading bool
+	var rawOut []string
+	var name string
+	var reading, done bool
 	scanner := bufio.NewScanner(conn)
 	for scanner.Scan() {
 		t := scanner.Text()
 		if t == "---" {
+			done = true
 			break
 		}
 		if strings.HasPrefix(t, "PyON") {
+			// Header is "PyON <version> <name>"
+			if fields := strings.Fields(t); len(fields) > 2 {
+				name = fields[2]
+			}
 			reading = true
 			continue
 		}
+		if !reading && strings.HasPrefix(t, "ERROR") {
+			recordResponse(conn, command, "", "", t)
+			err = fmt.Errorf("%s: %s", command, t)
+			return
+		}
 		if reading {
-			rawOut += t
+			rawOut = append(rawOut, t)
 		}
 	}
-	outJSON = strings.ReplaceAll(rawOut, ": None", ": null")
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if !done {
+		err = fmt.Errorf("%s: connection closed before end of response", command)
+		return
+	}
+	recordResponse(conn, command, name, strings.Join(rawOut, "\n"), "")
+	outJSON = strings.ReplaceAll(strings.Join(rawOut, ""), ": None", ": null")
 	outJSON = strings.ReplaceAll(outJSON, ": True", ": true")
 	outJSON = strings.ReplaceAll(outJSON, ": False", ": false")
 	return
@@ -64,6 +92,39 @@ func ReadAPI(endpoint string, target interface{}) error {
 	return json.NewDecoder(resp.Body).Decode(target)
 }
 
+// parseFAHDuration parses the human readable durations used by the FAH client
+// such as "2 hours 03 mins" or "1.99 days"
+func parseFAHDuration(s string) (d time.Duration, err error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		err = fmt.Errorf("invalid duration %q", s)
+		return
+	}
+	for i := 0; i < len(fields); i += 2 {
+		var v float64
+		v, err = strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return
+		}
+		var unit time.Duration
+		switch strings.TrimSuffix(fields[i+1], "s") {
+		case "day":
+			unit = 24 * time.Hour
+		case "hour":
+			unit = time.Hour
+		case "min":
+			unit = time.Minute
+		case "sec":
+			unit = time.Second
+		default:
+			err = fmt.Errorf("unknown unit %q in duration %q", fields[i+1], s)
+			return
+		}
+		d += time.Duration(v * float64(unit))
+	}
+	return
+}
+
 // QueueInfo is the data from the queue-info command
 type QueueInfo struct {
 	ID             string `json:"id"`
@@ -95,6 +156,29 @@ type QueueInfo struct {
 	BaseCredit     string `json:"basecredit"`
 }
 
+// ProjectedCompletion estimates when the unit will finish based on its ETA
+func (q QueueInfo) ProjectedCompletion(now time.Time) (time.Time, error) {
+	eta, err := parseFAHDuration(q.Eta)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return now.Add(eta), nil
+}
+
+// DeadlineMargin is the time left between the projected completion and the
+// unit timeout, negative if the unit will miss its timeout
+func (q QueueInfo) DeadlineMargin(now time.Time) (time.Duration, error) {
+	completion, err := q.ProjectedCompletion(now)
+	if err != nil {
+		return 0, err
+	}
+	timeout, err := time.Parse(time.RFC3339, q.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	return timeout.Sub(completion), nil
+}
+
 // SlotInfo output from slot-info command
 type SlotInfo struct {
 	ID          string          `json:"id"`
@@ -110,11 +194,35 @@ type SlotInfoOptions struct {
 	Paused bool `json:"paused"`
 }
 
+// SlotOptions output from slot-options command, all values are strings
+type SlotOptions struct {
+	Cause              string `json:"cause"`
+	ClientType         string `json:"client-type"`
+	ClientSubtype      string `json:"client-subtype"`
+	CorePriority       string `json:"core-priority"`
+	CPUs               string `json:"cpus"`
+	CPUUsage           string `json:"cpu-usage"`
+	GPUIndex           string `json:"gpu-index"`
+	GPUUsage           string `json:"gpu-usage"`
+	OpenCLIndex        string `json:"opencl-index"`
+	CUDAIndex          string `json:"cuda-index"`
+	MachineID          string `json:"machine-id"`
+	MaxPacketSize      string `json:"max-packet-size"`
+	MaxUnits           string `json:"max-units"`
+	NextUnitPercentage string `json:"next-unit-percentage"`
+	Checkpoint         string `json:"checkpoint"`
+	PauseOnStart       string `json:"pause-on-start"`
+	Paused             string `json:"paused"`
+	Idle               string `json:"idle"`
+}
+
 // Options output from options command
 type Options struct {
-	Power string `json:"power"`
-	Team  string `json:"team"`
-	User  string `json:"user"`
+	Cause   string `json:"cause"`
+	Passkey string `json:"passkey"`
+	Power   string `json:"power"`
+	Team    string `json:"team"`
+	User    string `json:"user"`
 }
 
 // DonorAPI from https://stats.foldingathome.org/api/donor/<user>
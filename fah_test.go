@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseFAHDuration(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want time.Duration
+		err  bool
+	}{
+		{in: "1 days 2 hours", want: 26 * time.Hour},
+		{in: "1.99 days", want: time.Duration(1.99 * float64(24*time.Hour))},
+		{in: "2 hours 03 mins", want: 2*time.Hour + 3*time.Minute},
+		{in: "3 mins 4 secs", want: 3*time.Minute + 4*time.Second},
+		{in: "1 min 1 sec", want: time.Minute + time.Second},
+		{in: "0.50 secs", want: 500 * time.Millisecond},
+		{in: "0.00 secs", want: 0},
+		{in: "unknown", err: true},
+		{in: "", err: true},
+		{in: "2 hours 03", err: true},
+		{in: "2 weeks", err: true},
+		{in: "two hours", err: true},
+	} {
+		got, err := parseFAHDuration(tc.in)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("parseFAHDuration(%q) = %v, %v, want %v, error %v", tc.in, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestDeadlineMargin(t *testing.T) {
+	now := time.Date(2020, 9, 5, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name    string
+		eta     string
+		timeout string
+		want    time.Duration
+		err     bool
+	}{
+		{name: "ahead", eta: "2 hours 03 mins", timeout: "2020-09-06T10:28:48Z", want: 20*time.Hour + 25*time.Minute + 48*time.Second},
+		{name: "exactly on time", eta: "1 hours", timeout: "2020-09-05T13:00:00Z", want: 0},
+		{name: "late", eta: "1 days 2 hours", timeout: "2020-09-06T12:00:00Z", want: -2 * time.Hour},
+		{name: "past timeout", eta: "0.00 secs", timeout: "2020-09-05T11:00:00Z", want: -time.Hour},
+		{name: "unknown ETA", eta: "unknown", timeout: "2020-09-06T12:00:00Z", err: true},
+		{name: "no timeout", eta: "1 hours", timeout: "", err: true},
+	} {
+		q := QueueInfo{Eta: tc.eta, Timeout: tc.timeout}
+		got, err := q.DeadlineMargin(now)
+		if (err != nil) != tc.err || got != tc.want {
+			t.Errorf("%s: got %v, %v, want %v, error %v", tc.name, got, err, tc.want, tc.err)
+		}
+	}
+}
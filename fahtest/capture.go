@@ -0,0 +1,98 @@
+package fahtest
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Record is one command and its raw response in a capture file.
+// Capture files contain one JSON encoded record per line.
+type Record struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client,omitempty"`
+	Command string    `json:"command"`
+	// Name of the PyON message, empty if the client sent an error
+	Name    string `json:"name,omitempty"`
+	Payload string `json:"payload,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// ReadCapture reads all records of a capture
+func ReadCapture(r io.Reader) ([]Record, error) {
+	var records []Record
+	scanner := bufio.NewScanner(r)
+	// Payloads can be much larger than the default token size
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, scanner.Err()
+}
+
+// ReadCaptureFile reads all records of a capture file
+func ReadCaptureFile(path string) ([]Record, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadCapture(f)
+}
+
+// Response converts the record to a server response
+func (rec Record) Response() Response {
+	if rec.Error != "" {
+		return Response{Error: strings.TrimPrefix(rec.Error, "ERROR: ")}
+	}
+	return Response{Name: rec.Name, Payload: rec.Payload}
+}
+
+// Replay responds to the recorded commands following the capture timeline.
+// Each command gets the latest response recorded at the same offset from the
+// start of the capture, speed scales time and loop restarts the capture at its end.
+func (s *Server) Replay(records []Record, speed float64, loop bool) {
+	if len(records) == 0 {
+		return
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	records = append([]Record(nil), records...)
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	first := records[0].Time
+	length := records[len(records)-1].Time.Sub(first)
+	byCommand := make(map[string][]Record)
+	for _, rec := range records {
+		byCommand[rec.Command] = append(byCommand[rec.Command], rec)
+	}
+	start := time.Now()
+	for command, recs := range byCommand {
+		recs := recs
+		s.HandleFunc(command, func([]string) Response {
+			offset := time.Duration(float64(time.Since(start)) * speed)
+			if loop && length > 0 {
+				offset %= length + 1
+			}
+			current := recs[0]
+			for _, rec := range recs[1:] {
+				if rec.Time.Sub(first) > offset {
+					break
+				}
+				current = rec
+			}
+			return current.Response()
+		})
+	}
+}
@@ -0,0 +1,27 @@
+package fahtest
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// PyON encodes a value the way the FAH client does, JSON with Python constants
+func PyON(v interface{}) (string, error) {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	out := strings.ReplaceAll(string(b), ": null", ": None")
+	out = strings.ReplaceAll(out, ": true", ": True")
+	out = strings.ReplaceAll(out, ": false", ": False")
+	return out, nil
+}
+
+// MustPyON is like PyON but panics on error
+func MustPyON(v interface{}) string {
+	out, err := PyON(v)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
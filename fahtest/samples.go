@@ -0,0 +1,90 @@
+package fahtest
+
+// Sample data of a client with one running GPU slot
+var (
+	SampleQueues = []map[string]interface{}{
+		{
+			"id":             "01",
+			"state":          "RUNNING",
+			"error":          "NO_ERROR",
+			"project":        13424,
+			"run":            0,
+			"clone":          1,
+			"gen":            2,
+			"core":           "0x22",
+			"unit":           "0x0000000300000002000034700000001",
+			"percentdone":    "16.53%",
+			"eta":            "2 hours 03 mins",
+			"ppd":            "1683157",
+			"creditestimate": "137823",
+			"waitingon":      "",
+			"nextattempt":    "0.00 secs",
+			"timeremaining":  "1.99 days",
+			"totalframes":    100,
+			"framesdone":     16,
+			"assigned":       "2020-09-05T10:28:48Z",
+			"timeout":        "2020-09-06T10:28:48Z",
+			"deadline":       "2020-09-07T10:28:48Z",
+			"ws":             "128.252.203.10",
+			"cs":             "155.247.166.219",
+			"attempts":       0,
+			"slot":           "01",
+			"tpf":            "1 mins 14 secs",
+			"basecredit":     "9405",
+		},
+	}
+	SampleSlots = []map[string]interface{}{
+		{
+			"id":          "01",
+			"status":      "RUNNING",
+			"description": "gpu:0:GP102 [GeForce GTX 1080 Ti] 11380",
+			"options":     map[string]interface{}{"paused": false},
+			"reason":      "",
+			"idle":        false,
+		},
+	}
+	SampleSlotOptions = map[string]interface{}{
+		"cause":                "ANY",
+		"checkpoint":           "15",
+		"client-subtype":       "LINUX",
+		"client-type":          "normal",
+		"core-priority":        "idle",
+		"cpus":                 "-1",
+		"gpu-index":            "0",
+		"idle":                 "false",
+		"machine-id":           "1",
+		"max-packet-size":      "normal",
+		"max-units":            "0",
+		"next-unit-percentage": "99",
+		"pause-on-start":       "false",
+		"paused":               "false",
+	}
+	SampleOptions = map[string]interface{}{
+		"passkey": "0123456789abcdef0123456789abcdef",
+		"power":   "full",
+		"team":    "0",
+		"user":    "Anonymous",
+	}
+	SampleInfo = []interface{}{
+		[]interface{}{"FAHClient",
+			[]string{"Version", "7.6.21"},
+			[]string{"OS", "Linux"},
+		},
+		[]interface{}{"System",
+			[]string{"CPU", "AMD Ryzen 9 3900X 12-Core Processor"},
+			[]string{"CPUs", "24"},
+			[]string{"GPUs", "1"},
+			[]string{"GPU 0", "gpu:0:GP102 [GeForce GTX 1080 Ti] 11380"},
+		},
+	}
+)
+
+// HandleSamples responds to the queue-info, slot-info, slot-options, options and info
+// commands with the sample data
+func (s *Server) HandleSamples() {
+	s.Handle("queue-info", Response{Name: "units", Payload: MustPyON(SampleQueues)})
+	s.Handle("slot-info", Response{Name: "slots", Payload: MustPyON(SampleSlots)})
+	s.Handle("slot-options", Response{Name: "slot-options", Payload: MustPyON(SampleSlotOptions)})
+	s.Handle("options", Response{Name: "options", Payload: MustPyON(SampleOptions)})
+	s.Handle("info", Response{Name: "info", Payload: MustPyON(SampleInfo)})
+}
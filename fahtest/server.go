@@ -0,0 +1,326 @@
+// Package fahtest provides a fake FAH v7 client command server for tests and local development.
+//
+// The server speaks the telnet protocol of the FAH client: a welcome banner, "> " prompts,
+// "PyON 1 <name>" framed messages terminated by "---", auth, updates and errors.
+// Latency, disconnects and malformed payloads can be injected.
+//
+//	srv := fahtest.NewServer()
+//	defer srv.Close()
+//	srv.Handle("queue-info", fahtest.Response{Name: "units", Payload: "[]"})
+package fahtest
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Welcome is the banner sent on connect
+const Welcome = "Welcome to the Folding@home Client command server."
+
+// Response is the reply to a command
+type Response struct {
+	// Name of the PyON message, such as "units" for queue-info
+	Name string
+	// Payload sent between the PyON header and terminator, use PyON to encode values
+	Payload string
+	// Error is sent instead of a PyON message when set
+	Error string
+	// Delay before responding, added to the server latency
+	Delay time.Duration
+	// Disconnect closes the connection instead of responding
+	Disconnect bool
+}
+
+// Commands without output, such as pause, respond with a zero Response which only sends the prompt
+
+// HandlerFunc builds the response to a command, args do not include the command name
+type HandlerFunc func(args []string) Response
+
+// Server is a fake FAH client command server
+type Server struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex    sync.Mutex
+	handlers map[string]HandlerFunc
+	password string
+	latency  time.Duration
+	conns    map[*conn]struct{}
+	commands []string
+}
+
+// conn is a connection to the server
+type conn struct {
+	net.Conn
+	// Writes come from both the command loop and updates
+	mutex   sync.Mutex
+	authed  bool
+	updates map[string]chan struct{}
+}
+
+// NewServer starts a server on a random local port with the sample data, it panics on failure
+func NewServer() *Server {
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("fahtest: failed to listen: %v", err))
+	}
+	s.HandleSamples()
+	return s
+}
+
+// Listen starts a server without any command handlers on addr
+func Listen(addr string) (*Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		listener: l,
+		handlers: make(map[string]HandlerFunc),
+		conns:    make(map[*conn]struct{}),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// Addr is the address the server listens on
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.Disconnect()
+	s.wg.Wait()
+	return err
+}
+
+// Handle responds to command with a fixed response.
+// The command is matched on the full command line first, then on its name.
+func (s *Server) Handle(command string, r Response) {
+	s.HandleFunc(command, func([]string) Response { return r })
+}
+
+// HandleFunc responds to command using f
+func (s *Server) HandleFunc(command string, f HandlerFunc) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[command] = f
+}
+
+// SetPassword requires clients to authenticate before running commands
+func (s *Server) SetPassword(password string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.password = password
+}
+
+// SetLatency delays every response
+func (s *Server) SetLatency(d time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.latency = d
+}
+
+// Disconnect closes all open connections
+func (s *Server) Disconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for c := range s.conns {
+		c.Close()
+	}
+}
+
+// Commands returns all commands received so far
+func (s *Server) Commands() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		nc, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &conn{Conn: nc, updates: make(map[string]chan struct{})}
+		s.mutex.Lock()
+		s.conns[c] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mutex.Lock()
+		delete(s.conns, c)
+		s.mutex.Unlock()
+		c.mutex.Lock()
+		for id, stop := range c.updates {
+			close(stop)
+			delete(c.updates, id)
+		}
+		c.mutex.Unlock()
+		c.Close()
+	}()
+	c.write(Welcome + "\n> ")
+	scanner := bufio.NewScanner(c)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			c.write("> ")
+			continue
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, line)
+		s.mutex.Unlock()
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "exit", "quit":
+			return
+		case "auth":
+			s.auth(c, fields[1:])
+			continue
+		}
+		if !c.isAuthed(s) {
+			c.write("\nERROR: authentication required\n> ")
+			continue
+		}
+		if fields[0] == "updates" {
+			s.updates(c, fields[1:])
+			continue
+		}
+		if !s.respond(c, line) {
+			return
+		}
+	}
+}
+
+func (c *conn) write(out string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Write([]byte(out))
+}
+
+func (c *conn) isAuthed(s *Server) bool {
+	s.mutex.Lock()
+	password := s.password
+	s.mutex.Unlock()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return password == "" || c.authed
+}
+
+func (s *Server) auth(c *conn, args []string) {
+	s.mutex.Lock()
+	password := s.password
+	s.mutex.Unlock()
+	if len(args) != 1 || args[0] != password {
+		c.write("\nERROR: invalid password\n> ")
+		return
+	}
+	c.mutex.Lock()
+	c.authed = true
+	c.mutex.Unlock()
+	c.write("OK\n> ")
+}
+
+// updates implements "updates add <id> <rate> <command>", "updates del <id>" and "updates clear"
+func (s *Server) updates(c *conn, args []string) {
+	if len(args) == 0 {
+		c.write("\nERROR: missing updates subcommand\n> ")
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stopUpdate := func(id string) {
+		if stop, ok := c.updates[id]; ok {
+			close(stop)
+			delete(c.updates, id)
+		}
+	}
+	switch {
+	case args[0] == "add" && len(args) >= 4:
+		rate, err := strconv.Atoi(args[2])
+		if err != nil || rate <= 0 {
+			c.Write([]byte("\nERROR: invalid update rate\n> "))
+			return
+		}
+		id := args[1]
+		stopUpdate(id)
+		stop := make(chan struct{})
+		c.updates[id] = stop
+		// The FAH client prefixes the command with $
+		command := strings.TrimPrefix(strings.Join(args[3:], " "), "$")
+		s.wg.Add(1)
+		go s.update(c, stop, time.Duration(rate)*time.Second, command)
+	case args[0] == "del" && len(args) == 2:
+		stopUpdate(args[1])
+	case args[0] == "clear":
+		for id := range c.updates {
+			stopUpdate(id)
+		}
+	default:
+		c.Write([]byte("\nERROR: invalid updates command\n> "))
+		return
+	}
+	c.Write([]byte("> "))
+}
+
+func (s *Server) update(c *conn, stop chan struct{}, rate time.Duration, command string) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(rate)
+	defer ticker.Stop()
+	for {
+		if !s.respond(c, command) {
+			c.Close()
+			return
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// respond sends the response to a command, returns false if the connection must be closed
+func (s *Server) respond(c *conn, line string) bool {
+	fields := strings.Fields(line)
+	s.mutex.Lock()
+	handler, ok := s.handlers[line]
+	if !ok {
+		handler, ok = s.handlers[fields[0]]
+	}
+	latency := s.latency
+	s.mutex.Unlock()
+	if !ok {
+		c.write(fmt.Sprintf("\nERROR: unknown command or variable '%s'\n> ", fields[0]))
+		return true
+	}
+	r := handler(fields[1:])
+	time.Sleep(latency + r.Delay)
+	switch {
+	case r.Disconnect:
+		return false
+	case r.Error != "":
+		c.write(fmt.Sprintf("\nERROR: %s\n> ", r.Error))
+	case r.Name == "" && r.Payload == "":
+		c.write("\n> ")
+	default:
+		c.write(fmt.Sprintf("\nPyON 1 %s\n%s\n---\n> ", r.Name, r.Payload))
+	}
+	return true
+}
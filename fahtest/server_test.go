@@ -0,0 +1,70 @@
+package fahtest
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readUntil reads lines from r until one has the prefix, failing on timeout
+func readUntil(t *testing.T, c net.Conn, r *bufio.Reader, prefix string) string {
+	t.Helper()
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading %q: %v", prefix, err)
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "> "))
+		if strings.HasPrefix(line, prefix) {
+			return line
+		}
+	}
+}
+
+func TestServerCommands(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+	srv.SetPassword("secret")
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	readUntil(t, c, r, Welcome)
+	c.Write([]byte("queue-info\n"))
+	readUntil(t, c, r, "ERROR: authentication required")
+	c.Write([]byte("auth secret\nqueue-info\n"))
+	if line := readUntil(t, c, r, "PyON"); line != "PyON 1 units" {
+		t.Errorf("got header %q", line)
+	}
+	c.Write([]byte("unknown\n"))
+	readUntil(t, c, r, "ERROR: unknown command")
+}
+
+func TestServerUpdates(t *testing.T) {
+	srv := NewServer()
+	c, err := net.Dial("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	r := bufio.NewReader(c)
+	c.Write([]byte("updates add 0 1 $slot-info\n"))
+	readUntil(t, c, r, "PyON 1 slots")
+	readUntil(t, c, r, "PyON 1 slots")
+	// Close waits for the update goroutine, which must not write after it returns
+	done := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not return")
+	}
+}
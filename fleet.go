@@ -0,0 +1,228 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// fleetStats are the aggregates of a group of clients
+type fleetStats struct {
+	Group       string         `json:"group"`
+	ClientsUp   int            `json:"clients_up"`
+	ClientsDown int            `json:"clients_down"`
+	PPD         float64        `json:"ppd"`
+	Slots       map[string]int `json:"slots"`
+	Units       map[string]int `json:"running_units"`
+	GPUs        map[string]int `json:"gpus"`
+}
+
+func newFleetStats(group string) *fleetStats {
+	s := &fleetStats{
+		Group: group,
+		Slots: make(map[string]int, len(slotStates)),
+		Units: make(map[string]int),
+		GPUs:  make(map[string]int),
+	}
+	for _, state := range slotStates {
+		s.Slots[state] = 0
+	}
+	return s
+}
+
+// add adds the last collection of a client
+func (s *fleetStats) add(snap Snapshot) {
+	if snap.Error != nil {
+		s.ClientsDown++
+		return
+	}
+	s.ClientsUp++
+	for _, slot := range snap.Data.Slots {
+		s.Slots[slot.Status]++
+		if model := gpuModel(slot.Description); model != "" {
+			s.GPUs[model]++
+		}
+	}
+	for _, q := range snap.Data.Queues {
+		if v := parseNumber(q.Ppd); v != nil {
+			s.PPD += *v
+		}
+		if q.State == "RUNNING" {
+			s.Units[strconv.Itoa(q.Project)]++
+		}
+	}
+}
+
+// gpuModel returns the model of a GPU slot description, GeForce GTX 1080 Ti for "gpu:0:GP102 [GeForce GTX 1080 Ti] 11380",
+// empty for CPU slots
+func gpuModel(description string) string {
+	parts := strings.SplitN(description, ":", 3)
+	if len(parts) < 3 || parts[0] != "gpu" {
+		return ""
+	}
+	model := parts[2]
+	if start, end := strings.Index(model, "["), strings.LastIndex(model, "]"); start >= 0 && end > start {
+		return strings.TrimSpace(model[start+1 : end])
+	}
+	// Drop the trailing GFLOPS estimate
+	fields := strings.Fields(model)
+	if len(fields) > 1 {
+		if _, err := strconv.Atoi(fields[len(fields)-1]); err == nil {
+			fields = fields[:len(fields)-1]
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// aggregateFleet returns the aggregates of every group sorted by name, clients without a group are in the "" group.
+// Clients which were never collected are left out.
+func aggregateFleet(clients []*Client, snapshot func(c *Client) Snapshot) []*fleetStats {
+	groups := make(map[string]*fleetStats)
+	for _, c := range clients {
+		s, ok := groups[c.Group]
+		if !ok {
+			s = newFleetStats(c.Group)
+			groups[c.Group] = s
+		}
+		if snap := snapshot(c); !snap.Time.IsZero() {
+			s.add(snap)
+		}
+	}
+	stats := make([]*fleetStats, 0, len(groups))
+	for _, s := range groups {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Group < stats[j].Group })
+	return stats
+}
+
+// FleetCollector exports aggregates of all clients by group
+type FleetCollector struct {
+	clients *ClientSet
+	mutex   sync.Mutex
+
+	clientsVec *prometheus.GaugeVec
+	ppd        *prometheus.GaugeVec
+	slots      *prometheus.GaugeVec
+	units      *prometheus.GaugeVec
+	gpus       *prometheus.GaugeVec
+}
+
+// NewFleetCollector creates the collector, it aggregates the last collection of the exporters
+// rather than collecting the clients again
+func NewFleetCollector(clients *ClientSet) *FleetCollector {
+	return &FleetCollector{
+		clients: clients,
+		clientsVec: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fleet_clients",
+				Help:      "Number of clients by state (up, down)",
+			},
+			[]string{"group", "state"},
+		),
+		ppd: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fleet_ppd",
+				Help:      "Total points per day of all clients",
+			},
+			[]string{"group"},
+		),
+		slots: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fleet_slots",
+				Help:      "Number of folding slots by status",
+			},
+			[]string{"group", "status"},
+		),
+		units: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fleet_running_units",
+				Help:      "Number of running work units by project",
+			},
+			[]string{"group", "project"},
+		),
+		gpus: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "fleet_gpus",
+				Help:      "Number of GPU slots by model",
+			},
+			[]string{"group", "model"},
+		),
+	}
+}
+
+// Describe implements prometheus.Collector
+func (f *FleetCollector) Describe(descs chan<- *prometheus.Desc) {
+	f.clientsVec.Describe(descs)
+	f.ppd.Describe(descs)
+	f.slots.Describe(descs)
+	f.units.Describe(descs)
+	f.gpus.Describe(descs)
+}
+
+// Collect implements prometheus.Collector
+func (f *FleetCollector) Collect(metrics chan<- prometheus.Metric) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	// Projects and models come and go, rebuild everything on every scrape
+	f.clientsVec.Reset()
+	f.ppd.Reset()
+	f.slots.Reset()
+	f.units.Reset()
+	f.gpus.Reset()
+	for _, s := range aggregateFleet(f.clients.All(), (*Client).lastSnapshot) {
+		f.clientsVec.WithLabelValues(s.Group, "up").Set(float64(s.ClientsUp))
+		f.clientsVec.WithLabelValues(s.Group, "down").Set(float64(s.ClientsDown))
+		f.ppd.WithLabelValues(s.Group).Set(s.PPD)
+		for status, n := range s.Slots {
+			f.slots.WithLabelValues(s.Group, status).Set(float64(n))
+		}
+		for project, n := range s.Units {
+			f.units.WithLabelValues(s.Group, project).Set(float64(n))
+		}
+		for model, n := range s.GPUs {
+			f.gpus.WithLabelValues(s.Group, model).Set(float64(n))
+		}
+	}
+	f.clientsVec.Collect(metrics)
+	f.ppd.Collect(metrics)
+	f.slots.Collect(metrics)
+	f.units.Collect(metrics)
+	f.gpus.Collect(metrics)
+}
+
+// fleetHandler serves the aggregates of every group and of the whole fleet
+func fleetHandler(set *ClientSet, maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		groups := aggregateFleet(set.All(), func(c *Client) Snapshot { return c.Snapshot(maxAge) })
+		total := newFleetStats("")
+		for _, g := range groups {
+			total.ClientsUp += g.ClientsUp
+			total.ClientsDown += g.ClientsDown
+			total.PPD += g.PPD
+			for k, v := range g.Slots {
+				total.Slots[k] += v
+			}
+			for k, v := range g.Units {
+				total.Units[k] += v
+			}
+			for k, v := range g.GPUs {
+				total.GPUs[k] += v
+			}
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Total  *fleetStats   `json:"total"`
+			Groups []*fleetStats `json:"groups"`
+		}{total, groups})
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestFleetCollector(t *testing.T) {
+	srv := newTestServer(t)
+	set := NewClientSet(true)
+	if err := set.Add(ClientConfig{Name: "fleet-a", Address: srv.Addr(), Group: "lab"}); err != nil {
+		t.Fatal(err)
+	}
+	defer set.remove("fleet-a")
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(NewFleetCollector(set))
+
+	// Clients which were never collected are not counted, nor collected by the fleet collector
+	assertMetrics(t, reg, `
+# HELP fah_fleet_clients Number of clients by state (up, down)
+# TYPE fah_fleet_clients gauge
+fah_fleet_clients{group="lab",state="down"} 0
+fah_fleet_clients{group="lab",state="up"} 0
+`, "fah_fleet_clients")
+	if cmds := srv.Commands(); len(cmds) != 0 {
+		t.Fatalf("fleet collector ran %v", cmds)
+	}
+
+	// Per-client series have the group label
+	if err := testutil.GatherAndCompare(prometheus.DefaultGatherer, strings.NewReader(`
+# HELP fah_up FAH Metric Collection Operational
+# TYPE fah_up gauge
+fah_up{client="fleet-a",group="lab"} 1
+`), "fah_up"); err != nil {
+		t.Error(err)
+	}
+	collected := len(srv.Commands())
+	assertMetrics(t, reg, `
+# HELP fah_fleet_clients Number of clients by state (up, down)
+# TYPE fah_fleet_clients gauge
+fah_fleet_clients{group="lab",state="down"} 0
+fah_fleet_clients{group="lab",state="up"} 1
+# HELP fah_fleet_ppd Total points per day of all clients
+# TYPE fah_fleet_ppd gauge
+fah_fleet_ppd{group="lab"} 1.683157e+06
+`, "fah_fleet_clients", "fah_fleet_ppd")
+	if n := len(srv.Commands()); n != collected {
+		t.Errorf("fleet collector sent %d commands", n-collected)
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+)
+
+// maxUDPPayload keeps line protocol datagrams below a typical MTU
+const maxUDPPayload = 1400
+
+// InfluxConfig configures writing the collected metrics as InfluxDB line protocol
+type InfluxConfig struct {
+	// URL of the InfluxDB server, udp://host:port for the UDP listener or stdout
+	URL string `yaml:"url"`
+	// Version of the HTTP API, 1 or 2
+	Version int `yaml:"version"`
+	// Database, RetentionPolicy, Username and Password are used by v1
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention_policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	// Org, Bucket and Token are used by v2
+	Org    string `yaml:"org"`
+	Bucket string `yaml:"bucket"`
+	Token  string `yaml:"token"`
+	// Measurements renames metrics, metrics not listed keep their name
+	Measurements map[string]string `yaml:"measurements"`
+	// Tags added to every point
+	Tags map[string]string `yaml:"tags"`
+	// BatchSize is the maximum number of lines per write
+	BatchSize int           `yaml:"batch_size"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// InfluxWriter periodically writes the exporter metrics as line protocol
+type InfluxWriter struct {
+	cfg      InfluxConfig
+	gatherer prometheus.Gatherer
+	write    func([]byte) error
+}
+
+// NewInfluxWriter validates the configuration and applies defaults
+func NewInfluxWriter(cfg InfluxConfig, gatherer prometheus.Gatherer) (*InfluxWriter, error) {
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 1000
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	w := &InfluxWriter{cfg: cfg, gatherer: gatherer}
+	if cfg.URL == "stdout" {
+		w.write = func(b []byte) error {
+			_, err := os.Stdout.Write(b)
+			return err
+		}
+		return w, nil
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid InfluxDB URL: %w", err)
+	}
+	switch u.Scheme {
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		w.write = func(b []byte) error {
+			_, err := conn.Write(b)
+			return err
+		}
+	case "http", "https":
+		endpoint, header, err := influxEndpoint(cfg, u)
+		if err != nil {
+			return nil, err
+		}
+		w.write = func(b []byte) error {
+			return influxPost(endpoint, header, b)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB URL %q, use http(s)://, udp:// or stdout", cfg.URL)
+	}
+	return w, nil
+}
+
+// influxEndpoint builds the write URL and authentication of the HTTP API version
+func influxEndpoint(cfg InfluxConfig, u *url.URL) (string, http.Header, error) {
+	header := make(http.Header)
+	q := url.Values{"precision": {"ns"}}
+	switch cfg.Version {
+	case 0, 1:
+		if cfg.Database == "" {
+			return "", nil, fmt.Errorf("InfluxDB v1 requires a database")
+		}
+		u = u.JoinPath("write")
+		q.Set("db", cfg.Database)
+		if cfg.RetentionPolicy != "" {
+			q.Set("rp", cfg.RetentionPolicy)
+		}
+		if cfg.Username != "" {
+			auth := base64.StdEncoding.EncodeToString([]byte(cfg.Username + ":" + cfg.Password))
+			header.Set("Authorization", "Basic "+auth)
+		}
+	case 2:
+		if cfg.Org == "" || cfg.Bucket == "" {
+			return "", nil, fmt.Errorf("InfluxDB v2 requires an org and bucket")
+		}
+		u = u.JoinPath("api", "v2", "write")
+		q.Set("org", cfg.Org)
+		q.Set("bucket", cfg.Bucket)
+		if cfg.Token != "" {
+			header.Set("Authorization", "Token "+cfg.Token)
+		}
+	default:
+		return "", nil, fmt.Errorf("unsupported InfluxDB version %d", cfg.Version)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), header, nil
+}
+
+func influxPost(endpoint string, header http.Header, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header = header.Clone()
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	resp, err := myClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Run writes the metrics every interval until the process exits
+func (w *InfluxWriter) Run() {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		if err := w.Write(); err != nil {
+			log.Errorf("Cannot write to InfluxDB: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// Write gathers the metrics and writes them in batches
+func (w *InfluxWriter) Write() error {
+	families := gatherFAH(w.gatherer, "InfluxDB")
+	lines := w.lines(families, time.Now())
+	udp := strings.HasPrefix(w.cfg.URL, "udp://")
+	var batch bytes.Buffer
+	count := 0
+	flush := func() error {
+		if batch.Len() == 0 {
+			return nil
+		}
+		err := w.write(batch.Bytes())
+		batch.Reset()
+		count = 0
+		return err
+	}
+	for _, line := range lines {
+		if count >= w.cfg.BatchSize || (udp && batch.Len()+len(line) > maxUDPPayload) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch.WriteString(line)
+		count++
+	}
+	return flush()
+}
+
+// lines converts the metric families to line protocol, each sample is a point with a value field
+func (w *InfluxWriter) lines(families []*dto.MetricFamily, now time.Time) []string {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	var lines []string
+	for _, mf := range families {
+		name := mf.GetName()
+		if m, ok := w.cfg.Measurements[name]; ok {
+			name = m
+		}
+		for _, m := range mf.GetMetric() {
+			value, ok := sampleValue(m)
+			// Line protocol has no NaN or infinity
+			if !ok || math.IsNaN(value) || math.IsInf(value, 0) {
+				continue
+			}
+			tags := make(map[string]string, len(w.cfg.Tags)+len(m.GetLabel()))
+			for k, v := range w.cfg.Tags {
+				tags[k] = v
+			}
+			for _, l := range m.GetLabel() {
+				tags[l.GetName()] = l.GetValue()
+			}
+			lines = append(lines, influxLine(name, tags, value, ts))
+		}
+	}
+	return lines
+}
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	tagEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// influxLine formats a point, tags are sorted and empty tags are dropped as InfluxDB rejects them
+func influxLine(measurement string, tags map[string]string, value float64, ts string) string {
+	keys := make([]string, 0, len(tags))
+	for k, v := range tags {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(measurementEscaper.Replace(measurement))
+	for _, k := range keys {
+		b.WriteByte(',')
+		b.WriteString(tagEscaper.Replace(k))
+		b.WriteByte('=')
+		b.WriteString(tagEscaper.Replace(strings.ReplaceAll(tags[k], "\n", " ")))
+	}
+	b.WriteString(" value=")
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte(' ')
+	b.WriteString(ts)
+	b.WriteByte('\n')
+	return b.String()
+}
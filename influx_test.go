@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestInfluxLine(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		measurement string
+		tags        map[string]string
+		want        string
+	}{
+		{"plain", "fah_up", map[string]string{"client": "desktop"}, "fah_up,client=desktop value=1.5 1000\n"},
+		{"sorted tags", "fah_ppd", map[string]string{"slot": "00", "client": "a", "queue": "01"}, "fah_ppd,client=a,queue=01,slot=00 value=1.5 1000\n"},
+		{"escaped measurement", "folding at,home", nil, `folding\ at\,home value=1.5 1000` + "\n"},
+		{"escaped tags", "fah_description", map[string]string{"description": "cpu:4 a=b,c", "tag key": "v"},
+			`fah_description,description=cpu:4\ a\=b\,c,tag\ key=v value=1.5 1000` + "\n"},
+		{"empty tags dropped", "fah_queue_info", map[string]string{"error": "", "slot": "00"}, "fah_queue_info,slot=00 value=1.5 1000\n"},
+		{"newlines", "fah_description", map[string]string{"description": "a\nb"}, `fah_description,description=a\ b value=1.5 1000` + "\n"},
+	} {
+		if got := influxLine(tc.measurement, tc.tags, 1.5, "1000"); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// newInfluxRegistry has one fah_ppd series per slot, and series which cannot be written
+func newInfluxRegistry(slots int) *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	ppd := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fah_ppd", Help: "ppd"}, []string{"slot", "queue"})
+	for i := 0; i < slots; i++ {
+		ppd.WithLabelValues(strconv.Itoa(i), "").Set(float64(i))
+	}
+	nan := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fah_nan", Help: "not a number"})
+	nan.Set(math.NaN())
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_other", Help: "not fah"})
+	reg.MustRegister(ppd, nan, other)
+	return reg
+}
+
+func TestInfluxLines(t *testing.T) {
+	w, err := NewInfluxWriter(InfluxConfig{
+		URL:          "stdout",
+		Measurements: map[string]string{"fah_ppd": "ppd"},
+		Tags:         map[string]string{"host": "lab", "slot": "overridden"},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := w.lines(gatherFAH(newInfluxRegistry(2), "test"), time.Unix(0, 42))
+	want := []string{"ppd,host=lab,slot=0 value=0 42\n", "ppd,host=lab,slot=1 value=1 42\n"}
+	if strings.Join(lines, "") != strings.Join(want, "") {
+		t.Errorf("got lines %q, want %q", lines, want)
+	}
+}
+
+func TestInfluxHTTP(t *testing.T) {
+	type request struct {
+		path, auth string
+		query      map[string]string
+		lines      int
+	}
+	var (
+		mutex    sync.Mutex
+		requests []request
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q := make(map[string]string)
+		for k := range r.URL.Query() {
+			q[k] = r.URL.Query().Get(k)
+		}
+		mutex.Lock()
+		requests = append(requests, request{path: r.URL.Path, auth: r.Header.Get("Authorization"), query: q, lines: strings.Count(string(body), "\n")})
+		mutex.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		name string
+		cfg  InfluxConfig
+		want request
+	}{
+		{"v1", InfluxConfig{Database: "fah", RetentionPolicy: "week", Username: "user", Password: "pass"},
+			request{path: "/influx/write", auth: "Basic dXNlcjpwYXNz", query: map[string]string{"db": "fah", "rp": "week", "precision": "ns"}}},
+		{"v1 without auth", InfluxConfig{Version: 1, Database: "fah"},
+			request{path: "/influx/write", query: map[string]string{"db": "fah", "precision": "ns"}}},
+		{"v2", InfluxConfig{Version: 2, Org: "lab", Bucket: "fah", Token: "secret"},
+			request{path: "/influx/api/v2/write", auth: "Token secret", query: map[string]string{"org": "lab", "bucket": "fah", "precision": "ns"}}},
+	} {
+		requests = nil
+		tc.cfg.URL = srv.URL + "/influx"
+		tc.cfg.BatchSize = 2
+		w, err := NewInfluxWriter(tc.cfg, newInfluxRegistry(5))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if err := w.Write(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		// 5 lines in batches of 2
+		if len(requests) != 3 {
+			t.Fatalf("%s: got %d requests, want 3", tc.name, len(requests))
+		}
+		for i, r := range requests {
+			want := tc.want
+			want.lines = 2
+			if i == 2 {
+				want.lines = 1
+			}
+			if r.path != want.path || r.auth != want.auth || r.lines != want.lines || !reflect.DeepEqual(r.query, want.query) {
+				t.Errorf("%s: request %d is %+v, want %+v", tc.name, i, r, want)
+			}
+		}
+	}
+
+	for _, cfg := range []InfluxConfig{
+		{URL: srv.URL},
+		{URL: srv.URL, Version: 2, Org: "lab"},
+		{URL: srv.URL, Version: 3},
+	} {
+		if _, err := NewInfluxWriter(cfg, nil); err == nil {
+			t.Errorf("%+v: no error", cfg)
+		}
+	}
+}
+
+func TestInfluxUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	w, err := NewInfluxWriter(InfluxConfig{URL: "udp://" + conn.LocalAddr().String()}, newInfluxRegistry(200))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(); err != nil {
+		t.Fatal(err)
+	}
+	lines, datagrams := 0, 0
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for lines < 200 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d lines: %v", lines, err)
+		}
+		if n > maxUDPPayload {
+			t.Errorf("datagram of %d bytes", n)
+		}
+		if buf[n-1] != '\n' {
+			t.Errorf("datagram splits a line: %q", buf[:n])
+		}
+		datagrams++
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+	if datagrams < 2 {
+		t.Errorf("200 lines were sent in %d datagram", datagrams)
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/exporter-toolkit/web"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -18,29 +24,60 @@ var (
 	fahAddress  = defaultFahAddress
 	getAPI      = false
 	apiThrottle time.Duration
-	myClient    = &http.Client{Timeout: 10 * time.Second}
+	// Metric schema version, see schemaV1 and schemaV2
+	metricsSchema = schemaV1
+	myClient      = &http.Client{Timeout: 10 * time.Second}
+	config        Config
 )
 
 func main() {
+	// Anything but a flag is a CLI subcommand
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
+
 	var (
 		level              string
 		listenAddress      string
 		metricsPath        string
 		socketActivate     bool
 		noTimestamps       bool
+		configFile         string
+		recordDir          string
+		webConfigFile      string
+		refreshInterval    time.Duration
+		pollInterval       time.Duration
 		defaultThrottle, _ = time.ParseDuration("1h")
 	)
 
 	flag.StringVar(&level, "log.level", "info", "Set the output log level")
 	flag.BoolVar(&noTimestamps, "log.no-timestamps", false, "Disable logging timestamps, true when using systemd activation")
 	flag.StringVar(&listenAddress, "web.listen-address", "0.0.0.0:9659", "Address to listen on for web interface and telemetry.")
-	flag.StringVar(&metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics.")
+	flag.StringVar(&webConfigFile, "web.config.file", "", "Path to web configuration file enabling TLS or basic authentication, in the Prometheus exporter-toolkit format")
+	flag.StringVar(&metricsPath, "web.telemetry-path", "/metrics", "Path under which to expose metrics, empty to disable.")
+	flag.DurationVar(&refreshInterval, "web.refresh-interval", 30*time.Second, "How often the status page refreshes, also the maximum age of data served by the JSON API")
 	flag.BoolVar(&socketActivate, "systemd", false, "Run using systemd socket activation")
 	flag.StringVar(&fahAddress, "fah.address", defaultFahAddress, "Listen address of FAH client")
 	flag.BoolVar(&getAPI, "fah.api", false, "Get donor stats from FAH API")
 	flag.DurationVar(&apiThrottle, "fah.api-throttle", defaultThrottle, "How often to refresh API data")
+	flag.DurationVar(&pollInterval, "fah.poll-interval", 0, "Collect from clients in the background at this interval, for events without scrapes (0 to disable)")
+	flag.StringVar(&recordDir, "fah.record-dir", "", "Record redacted client responses to capture files in this directory")
+	flag.StringVar(&configFile, "config.file", "", "Path to configuration file, overrides -fah.address")
+	flag.StringVar(&sysfsPath, "path.sysfs", sysfsPath, "Mount point of sysfs, for RAPL and hwmon power sources")
+	flag.StringVar(&metricsSchema, "metrics.schema", schemaV1, "Metric schema version, v2 keeps volatile values out of labels (v1, v2)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage of %s [command]:\n", os.Args[0])
+		flag.PrintDefaults()
+		printCommands(flag.CommandLine.Output())
+	}
 	flag.Parse()
 	setLogLevel(level)
+	if metricsSchema != schemaV1 && metricsSchema != schemaV2 {
+		log.Fatalf("Unknown metric schema %q", metricsSchema)
+	}
+	if refreshInterval < time.Second {
+		log.Fatalf("Status page refresh interval must be at least 1s")
+	}
 
 	if noTimestamps || socketActivate {
 		log.SetFormatter(&log.TextFormatter{DisableTimestamp: true})
@@ -48,26 +85,225 @@ func main() {
 		log.SetFormatter(&log.TextFormatter{DisableTimestamp: false, FullTimestamp: true})
 	}
 
-	prometheus.MustRegister(NewExporter())
+	if recordDir != "" {
+		var err error
+		recorder, err = NewRecorder(recordDir)
+		if err != nil {
+			log.Fatalf("Cannot record client responses: %v", err)
+		}
+		log.Infof("Recording client responses to %s", recordDir)
+	}
+
+	events = NewEventHub(1000)
+	prometheus.MustRegister(eventsDropped)
+
+	var clients *ClientSet
+	// The discovery targets scrape the exporter with a client as the target parameter
+	scrape := newSDScrape(listenAddress, metricsPath)
+	if configFile != "" {
+		var err error
+		config, err = loadConfig(configFile)
+		if err != nil {
+			log.Fatalf("Cannot load config: %v", err)
+		}
+		if config.Discovery != nil && config.Discovery.ExporterAddress != "" {
+			scrape.Address = config.Discovery.ExporterAddress
+		}
+		if config.Privacy != nil {
+			privacy, err = NewPrivacy(*config.Privacy)
+			if err != nil {
+				log.Fatalf("Cannot configure privacy: %v", err)
+			}
+			log.AddHook(privacy)
+			// The desired user and team are known before any client is collected
+			if config.Desired != nil {
+				privacy.Register(fieldUser, config.Desired.User)
+				privacy.Register(fieldTeam, config.Desired.Team)
+			}
+		}
+		if config.Energy != nil {
+			energy, err = NewEnergyAccount(*config.Energy)
+			if err != nil {
+				log.Fatalf("Cannot configure energy accounting: %v", err)
+			}
+		}
+		// Label metrics by client when monitoring several clients
+		clients = NewClientSet(true)
+		for _, cc := range config.Clients {
+			// Unnamed clients are named after their address, which may be redacted
+			if cc.Name == cc.Address {
+				cc.Name = defaultClientName(cc.Address)
+			}
+			if err := clients.Add(cc); err != nil {
+				log.Fatalf("Cannot add client %s: %v", cc.Name, err)
+			}
+		}
+		prometheus.MustRegister(NewFleetCollector(clients))
+		if config.Discovery != nil {
+			discovery, err := NewDiscovery(*config.Discovery, clients, scrape)
+			if err != nil {
+				log.Fatalf("Cannot configure discovery: %v", err)
+			}
+			discovery.Run()
+		}
+	} else {
+		clients = NewClientSet(false)
+		if err := clients.Add(ClientConfig{Name: fahAddress, Address: fahAddress}); err != nil {
+			log.Fatalf("Cannot add client %s: %v", fahAddress, err)
+		}
+	}
+
+	// An empty path disables the endpoint when only pushing metrics
+	if metricsPath != "" {
+		http.Handle(metricsPath, metricsHandler(clients))
+	}
+	http.Handle("/api/v1/drift", driftHandler(clients, refreshInterval))
+	http.Handle("/api/v1/clients", clientsHandler(clients, refreshInterval))
+	http.Handle("/api/v1/clients/", clientsHandler(clients, refreshInterval))
+	http.Handle("/api/v1/events", eventsHandler(events))
+	http.Handle("/api/v1/fleet", fleetHandler(clients, refreshInterval))
+	http.Handle("/api/v1/targets", targetsHandler(clients, scrape))
+	http.Handle("/api/v1/targets/", targetsHandler(clients, scrape))
+	http.Handle("/", statusHandler(clients, metricsPath, refreshInterval))
+
+	if pollInterval > 0 {
+		go pollClients(clients, pollInterval)
+	}
+	if config.Desired != nil && config.Remediate {
+		go remediateClients(clients, config.Desired, config.RemediateInterval)
+	}
+	if len(config.Notifications.Webhooks) > 0 {
+		notifier, err := NewNotifier(config.Notifications, clients)
+		if err != nil {
+			log.Fatalf("Cannot configure notifications: %v", err)
+		}
+		if pollInterval == 0 {
+			log.Warnf("Notifications are only sent when clients are scraped, consider setting -fah.poll-interval")
+		}
+		go notifier.Run(events)
+	}
+	if config.MQTT != nil {
+		publisher, err := NewPublisher(*config.MQTT, clients)
+		if err != nil {
+			log.Fatalf("Cannot configure MQTT: %v", err)
+		}
+		go publisher.Run()
+	}
+	// The push outputs share their gathers, each would otherwise collect every client
+	gatherer := newSharedGatherer(prometheus.DefaultGatherer)
+	var (
+		pushIntervals []time.Duration
+		pushers       []func()
+	)
+	if config.InfluxDB != nil {
+		writer, err := NewInfluxWriter(*config.InfluxDB, gatherer)
+		if err != nil {
+			log.Fatalf("Cannot configure InfluxDB: %v", err)
+		}
+		pushIntervals = append(pushIntervals, writer.cfg.Interval)
+		pushers = append(pushers, writer.Run)
+	}
+	if config.RemoteWrite != nil {
+		writer, err := NewRemoteWriter(*config.RemoteWrite, gatherer)
+		if err != nil {
+			log.Fatalf("Cannot configure remote write: %v", err)
+		}
+		pushIntervals = append(pushIntervals, writer.cfg.Interval)
+		pushers = append(pushers, writer.Run)
+	}
+	if config.Pushgateway != nil {
+		pusher, err := NewPushgateway(*config.Pushgateway, gatherer, clients)
+		if err != nil {
+			log.Fatalf("Cannot configure Pushgateway: %v", err)
+		}
+		pushIntervals = append(pushIntervals, pusher.cfg.Interval)
+		pushers = append(pushers, pusher.Run)
+	}
+	if config.OTLP != nil {
+		exporter, err := NewOTLPExporter(*config.OTLP, gatherer, clients)
+		if err != nil {
+			log.Fatalf("Cannot configure OTLP: %v", err)
+		}
+		pushIntervals = append(pushIntervals, exporter.cfg.Interval)
+		pushers = append(pushers, exporter.Run)
+	}
 
-	http.Handle(metricsPath, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-             <head><title>FAH Exporter</title></head>
-             <body>
-             <h1>FAH Exporter</h1>
-             <p><a href='` + metricsPath + `'>Metrics</a></p>
-	     <h2>More information:</h2>
-	     <p><a href="https://github.com/cosandr/fah-exporter">github.com/cosandr/fah-exporter</a></p>
-             </body>
-             </html>`))
-	})
+	// Outputs ticking together reuse the same gather, half the shortest interval absorbs ticker jitter
+	for _, interval := range pushIntervals {
+		if gatherer.maxAge == 0 || interval/2 < gatherer.maxAge {
+			gatherer.maxAge = interval / 2
+		}
+	}
+	for _, run := range pushers {
+		go run()
+	}
 
+	if err := web.Validate(webConfigFile); err != nil {
+		log.Fatalf("Invalid web config: %v", err)
+	}
 	listener := getListener(socketActivate, listenAddress)
 
-	log.Infof("FAH client address: %s", fahAddress)
+	for _, c := range clients.All() {
+		log.Infof("FAH client %s address: %s", c.Name, c.Address)
+	}
 	log.Infof("Starting HTTP server on %s", listener.Addr().String())
-	log.Fatal(http.Serve(listener, nil))
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Infof("Shutting down")
+		shutdown()
+		os.Exit(0)
+	}()
+	err := serveWeb(listener, &http.Server{}, listenAddress, socketActivate, webConfigFile)
+	shutdown()
+	log.Fatal(err)
+}
+
+// serveWeb serves on listener with the TLS and basic authentication of the web config file
+func serveWeb(listener net.Listener, server *http.Server, listenAddress string, socketActivate bool, webConfigFile string) error {
+	flags := &web.FlagConfig{
+		WebListenAddresses: &[]string{listenAddress},
+		WebSystemdSocket:   &socketActivate,
+		WebConfigFile:      &webConfigFile,
+	}
+	return web.Serve(listener, server, flags, kitLogger{})
+}
+
+// shutdown flushes state which would be lost on exit
+func shutdown() {
+	if recorder != nil {
+		recorder.Close()
+	}
+	if energy != nil {
+		if err := energy.Save(); err != nil {
+			log.Errorf("Cannot save energy counters: %v", err)
+		}
+	}
+}
+
+// kitLogger adapts logrus to the go-kit logger used by the exporter toolkit
+type kitLogger struct{}
+
+func (kitLogger) Log(keyvals ...interface{}) error {
+	level := log.InfoLevel
+	msg := ""
+	fields := make(log.Fields, len(keyvals)/2)
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		switch key {
+		case "level":
+			if l, err := log.ParseLevel(fmt.Sprint(keyvals[i+1])); err == nil {
+				level = l
+			}
+		case "msg":
+			msg = fmt.Sprint(keyvals[i+1])
+		default:
+			fields[key] = keyvals[i+1]
+		}
+	}
+	log.WithFields(fields).Log(level, msg)
+	return nil
 }
 
 func setLogLevel(level string) {
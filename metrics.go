@@ -0,0 +1,113 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricSpec is the metadata of a metric the exporter defines, shared by NewExporter and
+// the dashboard generator
+type metricSpec struct {
+	// name without the namespace
+	name   string
+	help   string
+	labels []string
+	// exported reports whether the metric is exported for client with the current flags, always
+	// when nil. client is nil when the metrics are listed without a client, for the dashboard.
+	exported func(client *Client) bool
+}
+
+// fqName is the full metric name
+func (m metricSpec) fqName() string {
+	return prometheus.BuildFQName(namespace, "", m.name)
+}
+
+func (m metricSpec) gauge() prometheus.Gauge {
+	return prometheus.NewGauge(prometheus.GaugeOpts{Namespace: namespace, Name: m.name, Help: m.help})
+}
+
+func (m metricSpec) gaugeVec() *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Namespace: namespace, Name: m.name, Help: m.help}, m.labels)
+}
+
+func (m metricSpec) counterVec() *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Namespace: namespace, Name: m.name, Help: m.help}, m.labels)
+}
+
+// Conditions of the metrics which are not always exported
+func schemaV2Enabled(*Client) bool { return metricsSchema == schemaV2 }
+func apiEnabled(*Client) bool      { return getAPI }
+func auditEnabled(*Client) bool    { return config.Desired != nil }
+func powerEnabled(c *Client) bool  { return c != nil && c.power != nil }
+func energyEnabled(c *Client) bool { return powerEnabled(c) && energy != nil }
+func costEnabled(c *Client) bool   { return energyEnabled(c) && energy.Currency() != "" }
+func co2Enabled(c *Client) bool    { return energyEnabled(c) && energy.Carbon() }
+
+// exporterMetrics returns the metadata of every metric the exporter defines for the metric schema in use
+func exporterMetrics() []metricSpec {
+	slotQueue := []string{"slot", "queue"}
+	pausedLabels := []string{"slot", "reason"}
+	queueInfoLabels := []string{"slot", "queue", "state", "eta", "error"}
+	queueInfoHelp := "Task state, ETA and eventual error"
+	if metricsSchema == schemaV2 {
+		pausedLabels = []string{"slot"}
+		queueInfoLabels = []string{"slot", "queue", "project", "run", "clone", "gen", "core", "unit"}
+		queueInfoHelp = "Task identity"
+	}
+	return []metricSpec{
+		// Generic info
+		{name: "up", help: "FAH Metric Collection Operational"},
+		{name: "slot_count", help: "Count of folding slots"},
+		{name: "options", help: "Client options", labels: []string{"user", "team", "power"}},
+		// Slot info
+		{name: "description", help: "Folding slot description", labels: []string{"slot", "description"}},
+		{name: "idle", help: "Whether slot is idle", labels: []string{"slot"}},
+		{name: "paused", help: "Whether slot is paused", labels: pausedLabels},
+		{name: "slot_status", help: "Folding slot status, one series per known status", labels: []string{"slot", "status"}},
+		// Slot options
+		{name: "slot_options_info", help: "Folding slot configuration",
+			labels: []string{"slot", "cause", "client_type", "client_subtype", "core_priority", "gpu_index", "max_packet_size"}},
+		{name: "slot_cpus", help: "Number of CPUs the slot is configured to use", labels: []string{"slot"}},
+		{name: "slot_next_unit_percentage", help: "Percentage done at which the next unit is downloaded", labels: []string{"slot"}},
+		{name: "slot_max_units", help: "Maximum units the slot will process, 0 for no limit", labels: []string{"slot"}},
+		{name: "slot_checkpoint_minutes", help: "Slot checkpoint frequency in minutes", labels: []string{"slot"}},
+		// Queue info
+		{name: "frames_done", help: "Task frames done", labels: slotQueue},
+		{name: "total_frames", help: "Task total frames", labels: slotQueue},
+		{name: "percent_done", help: "Task percent done", labels: slotQueue},
+		{name: "ppd", help: "Task points per day", labels: slotQueue},
+		{name: "queue_info", help: queueInfoHelp, labels: queueInfoLabels},
+		{name: "queue_state", help: "Task state, one series per known state", labels: []string{"slot", "queue", "state"}},
+		// Queue values (schema v2)
+		{name: "queue_error", help: "Task error", labels: []string{"slot", "queue", "error"}, exported: schemaV2Enabled},
+		{name: "queue_eta_seconds", help: "Task estimated time to completion", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_time_remaining_seconds", help: "Task time remaining until the deadline", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_tpf_seconds", help: "Task time per frame", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_next_attempt_seconds", help: "Time until the next attempt", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_attempts", help: "Task attempts", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_credit_estimate", help: "Task estimated credit", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_base_credit", help: "Task base credit", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_assigned_timestamp_seconds", help: "Time the task was assigned", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_timeout_timestamp_seconds", help: "Time the task times out", labels: slotQueue, exported: schemaV2Enabled},
+		{name: "queue_deadline_timestamp_seconds", help: "Time the task expires", labels: slotQueue, exported: schemaV2Enabled},
+		// Deadline risk
+		{name: "unit_projected_completion_timestamp_seconds", help: "Projected completion time of the unit based on its ETA", labels: slotQueue},
+		{name: "unit_deadline_margin_seconds", help: "Time between projected completion and unit timeout, negative if it will miss the timeout", labels: slotQueue},
+		{name: "unit_at_risk", help: "Whether the unit is projected to miss its timeout", labels: slotQueue},
+		// Donor API
+		{name: "donor_credit", help: "Donor total credit", labels: []string{"user"}, exported: apiEnabled},
+		{name: "donor_id", help: "Donor user ID", labels: []string{"user"}, exported: apiEnabled},
+		{name: "donor_rank", help: "Donor rank", labels: []string{"user"}, exported: apiEnabled},
+		{name: "donor_team_credit", help: "Donor credit per team", labels: []string{"user", "name", "team"}, exported: apiEnabled},
+		// Configuration audit
+		{name: "config_drift", help: "Whether the setting differs from the desired state, slot is empty for client settings",
+			labels: []string{"setting", "slot"}, exported: auditEnabled},
+		// Power sources
+		{name: "power_watts", help: "Power draw of the slot, or of the host when slot is empty", labels: []string{"slot", "source"}, exported: powerEnabled},
+		{name: "ppd_per_watt", help: "Points per day per watt of the slot, or of the host when slot is empty", labels: []string{"slot"}, exported: powerEnabled},
+		// Energy accounting
+		{name: "energy_joules_total", help: "Energy used by the slot, or by the host when slot is empty", labels: []string{"slot"}, exported: energyEnabled},
+		{name: "energy_cost_total", help: "Electricity cost of the slot, or of the host when slot is empty", labels: []string{"slot", "currency"}, exported: costEnabled},
+		{name: "co2_grams_total", help: "Carbon emissions of the energy used by the slot, or by the host when slot is empty", labels: []string{"slot"}, exported: co2Enabled},
+		{name: "credit_per_currency", help: "Points earned per currency unit at the current power and price", labels: []string{"slot", "currency"}, exported: costEnabled},
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// MQTTConfig configures publishing to an MQTT broker
+type MQTTConfig struct {
+	// Broker URL, for example tcp://localhost:1883 or ssl://broker:8883
+	Broker   string `yaml:"broker"`
+	ClientID string `yaml:"client_id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// TopicPrefix of the state and command topics
+	TopicPrefix string `yaml:"topic_prefix"`
+	// DiscoveryPrefix of the Home Assistant discovery topics, discovery is disabled when Discovery is false
+	DiscoveryPrefix string `yaml:"discovery_prefix"`
+	Discovery       *bool  `yaml:"discovery"`
+	// Commands enables the command topics, anyone allowed to publish to them can control the slots
+	Commands bool `yaml:"commands"`
+	// Interval between publishes, also the maximum age of the published data
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Slot commands accepted on the command topics
+var mqttCommands = map[string]bool{"pause": true, "unpause": true, "finish": true}
+
+var mqttInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mqttID makes a name safe to use in topics and Home Assistant IDs
+func mqttID(name string) string {
+	return mqttInvalid.ReplaceAllString(name, "_")
+}
+
+// mqttSlotState is the payload of a slot state topic
+type mqttSlotState struct {
+	Status      string   `json:"status"`
+	Description string   `json:"description"`
+	Paused      bool     `json:"paused"`
+	Project     string   `json:"project"`
+	Progress    *float64 `json:"progress"`
+	PPD         *float64 `json:"ppd"`
+	EtaSeconds  *float64 `json:"eta_seconds"`
+}
+
+// Publisher publishes client snapshots to MQTT
+type Publisher struct {
+	cfg     MQTTConfig
+	clients *ClientSet
+	conn    mqtt.Client
+
+	mutex sync.Mutex
+	// Slots with published discovery config by client, to remove slots which disappear
+	slots map[string]map[string]bool
+	// Clients with published donor discovery config
+	donors map[string]bool
+}
+
+// NewPublisher validates the configuration and applies defaults
+func NewPublisher(cfg MQTTConfig, clients *ClientSet) (*Publisher, error) {
+	if cfg.Broker == "" {
+		return nil, fmt.Errorf("mqtt has no broker")
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "fah-exporter"
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "fah"
+	}
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = "homeassistant"
+	}
+	if cfg.Discovery == nil {
+		enabled := true
+		cfg.Discovery = &enabled
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	p := &Publisher{
+		cfg:     cfg,
+		clients: clients,
+		slots:   make(map[string]map[string]bool),
+		donors:  make(map[string]bool),
+	}
+	opts := mqtt.NewClientOptions().
+		AddBroker(cfg.Broker).
+		SetClientID(cfg.ClientID).
+		SetUsername(cfg.Username).
+		SetPassword(cfg.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetWill(p.statusTopic(), "offline", 1, true).
+		SetOnConnectHandler(p.onConnect).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			log.Warnf("MQTT connection lost: %v", err)
+		})
+	p.conn = mqtt.NewClient(opts)
+	return p, nil
+}
+
+func (p *Publisher) statusTopic() string {
+	return p.cfg.TopicPrefix + "/status"
+}
+
+func (p *Publisher) clientTopic(c *Client) string {
+	return p.cfg.TopicPrefix + "/" + mqttID(c.Name)
+}
+
+func (p *Publisher) slotTopic(c *Client, slot string) string {
+	return p.clientTopic(c) + "/" + mqttID(slot)
+}
+
+// Run connects to the broker and publishes every interval until the process exits
+func (p *Publisher) Run() {
+	// Connect retries in the background, messages are queued until connected
+	p.conn.Connect()
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		for _, c := range p.clients.All() {
+			p.publishClient(c, c.Snapshot(p.cfg.Interval))
+		}
+		<-ticker.C
+	}
+}
+
+// onConnect marks the exporter online and subscribes to the command topics
+func (p *Publisher) onConnect(conn mqtt.Client) {
+	log.Infof("Connected to MQTT broker %s", p.cfg.Broker)
+	p.publish(p.statusTopic(), "online")
+	if !p.cfg.Commands {
+		return
+	}
+	// A single subscription covers clients discovered later
+	topic := p.cfg.TopicPrefix + "/+/+/set"
+	token := conn.Subscribe(topic, 1, func(_ mqtt.Client, msg mqtt.Message) {
+		// Commands connect to the FAH client, keep them off the MQTT router
+		go p.handleCommand(msg)
+	})
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Errorf("Cannot subscribe to %s: %v", topic, token.Error())
+		}
+	}()
+}
+
+// handleCommand runs the slot command received on <prefix>/<client>/<slot>/set
+func (p *Publisher) handleCommand(msg mqtt.Message) {
+	command := strings.ToLower(strings.TrimSpace(string(msg.Payload())))
+	if !mqttCommands[command] {
+		log.Warnf("Ignoring unknown MQTT command %q on %s", command, msg.Topic())
+		return
+	}
+	parts := strings.Split(msg.Topic(), "/")
+	id := parts[len(parts)-2]
+	// Topics use sanitized names, find the client they belong to
+	var c *Client
+	for _, candidate := range p.clients.All() {
+		if mqttID(candidate.Name) == parts[len(parts)-3] {
+			c = candidate
+			break
+		}
+	}
+	if c == nil {
+		log.Warnf("Ignoring MQTT command %s for unknown client on %s", command, msg.Topic())
+		return
+	}
+	// Topics use sanitized IDs, find the actual slot in the last snapshot
+	var slot string
+	for _, s := range c.Snapshot(p.cfg.Interval).Data.Slots {
+		if mqttID(s.ID) == id {
+			slot = s.ID
+			break
+		}
+	}
+	if slot == "" {
+		log.Warnf("Ignoring MQTT command %s for unknown slot %s on %s", command, id, c.Name)
+		return
+	}
+	log.Infof("Running %s on slot %s of %s from MQTT", command, slot, c.Name)
+	if err := c.SlotCommand(command, slot); err != nil {
+		log.Errorf("Cannot %s slot %s on %s: %v", command, slot, c.Name, err)
+		return
+	}
+	// Publish the new state right away
+	p.publishClient(c, c.Snapshot(0))
+}
+
+// publish sends a retained message without blocking on the broker
+func (p *Publisher) publish(topic string, payload interface{}) {
+	token := p.conn.Publish(topic, 1, true, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Errorf("Cannot publish to %s: %v", topic, token.Error())
+		}
+	}()
+}
+
+func (p *Publisher) publishJSON(topic string, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Cannot encode %s: %v", topic, err)
+		return
+	}
+	p.publish(topic, b)
+}
+
+// publishClient publishes the availability, slot states and donor credit of a client
+func (p *Publisher) publishClient(c *Client, s Snapshot) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	topic := p.clientTopic(c)
+	if s.Error != nil {
+		p.publish(topic+"/availability", "offline")
+		return
+	}
+	p.publish(topic+"/availability", "online")
+
+	seen := make(map[string]bool, len(s.Data.Slots))
+	for _, slot := range s.Data.Slots {
+		seen[slot.ID] = true
+		if *p.cfg.Discovery && !p.slots[c.Name][slot.ID] {
+			p.publishSlotDiscovery(c, slot)
+		}
+		p.publishJSON(p.slotTopic(c, slot.ID)+"/state", newMQTTSlotState(slot, s.Data.Queues))
+	}
+	if *p.cfg.Discovery {
+		for id := range p.slots[c.Name] {
+			if !seen[id] {
+				p.removeSlotDiscovery(c, id)
+			}
+		}
+	}
+	p.slots[c.Name] = seen
+
+	if getAPI && s.Data.Donor.Name != "" {
+		if *p.cfg.Discovery && !p.donors[c.Name] {
+			p.publishDonorDiscovery(c)
+			p.donors[c.Name] = true
+		}
+		p.publishJSON(topic+"/donor", map[string]interface{}{
+			"name":   s.Data.Donor.Name,
+			"rank":   s.Data.Donor.Rank,
+			"credit": s.Data.Donor.Credit,
+		})
+	}
+}
+
+// newMQTTSlotState summarizes a slot and its running unit
+func newMQTTSlotState(slot SlotInfo, queues []QueueInfo) mqttSlotState {
+	st := mqttSlotState{
+		Status:      slot.Status,
+		Description: slot.Description,
+		Paused:      slot.Options.Paused,
+	}
+	var unit *QueueInfo
+	for i, q := range queues {
+		if q.Slot != slot.ID {
+			continue
+		}
+		if unit == nil || q.State == "RUNNING" {
+			unit = &queues[i]
+		}
+	}
+	if unit != nil {
+		st.Project = fmt.Sprintf("%d (%d, %d, %d)", unit.Project, unit.Run, unit.Clone, unit.Gen)
+		st.Progress = parseNumber(unit.PercentDone)
+		st.PPD = parseNumber(unit.Ppd)
+		st.EtaSeconds = parseSeconds(unit.Eta)
+	}
+	return st
+}
+
+// haSensor is a sensor in the Home Assistant discovery config of a slot
+type haSensor struct {
+	key         string
+	name        string
+	unit        string
+	deviceClass string
+	stateClass  string
+	icon        string
+}
+
+var haSlotSensors = []haSensor{
+	{key: "status", name: "Status", icon: "mdi:state-machine"},
+	{key: "progress", name: "Progress", unit: "%", stateClass: "measurement", icon: "mdi:progress-clock"},
+	{key: "ppd", name: "PPD", unit: "PPD", stateClass: "measurement", icon: "mdi:speedometer"},
+	{key: "eta_seconds", name: "ETA", unit: "s", deviceClass: "duration", icon: "mdi:timer-sand"},
+	{key: "project", name: "Project", icon: "mdi:dna"},
+}
+
+func (p *Publisher) haAvailability(c *Client) []map[string]string {
+	return []map[string]string{
+		{"topic": p.statusTopic()},
+		{"topic": p.clientTopic(c) + "/availability"},
+	}
+}
+
+func (p *Publisher) haConfigTopic(component string, object string) string {
+	return p.cfg.DiscoveryPrefix + "/" + component + "/" + mqttID(p.cfg.ClientID) + "/" + object + "/config"
+}
+
+// publishSlotDiscovery publishes the Home Assistant config of a slot device with its sensors and buttons
+func (p *Publisher) publishSlotDiscovery(c *Client, slot SlotInfo) {
+	object := mqttID(c.Name) + "_" + mqttID(slot.ID)
+	device := map[string]interface{}{
+		"identifiers":  []string{"fah_" + object},
+		"name":         fmt.Sprintf("FAH %s slot %s", c.Name, slot.ID),
+		"model":        slot.Description,
+		"manufacturer": "Folding@home",
+	}
+	stateTopic := p.slotTopic(c, slot.ID) + "/state"
+	for _, s := range haSlotSensors {
+		cfg := map[string]interface{}{
+			"name":              s.name,
+			"unique_id":         "fah_" + object + "_" + s.key,
+			"object_id":         "fah_" + object + "_" + s.key,
+			"state_topic":       stateTopic,
+			"value_template":    "{{ value_json." + s.key + " }}",
+			"availability":      p.haAvailability(c),
+			"availability_mode": "all",
+			"device":            device,
+			"icon":              s.icon,
+		}
+		if s.unit != "" {
+			cfg["unit_of_measurement"] = s.unit
+		}
+		if s.deviceClass != "" {
+			cfg["device_class"] = s.deviceClass
+		}
+		if s.stateClass != "" {
+			cfg["state_class"] = s.stateClass
+		}
+		p.publishJSON(p.haConfigTopic("sensor", object+"_"+s.key), cfg)
+	}
+	paused := map[string]interface{}{
+		"name":              "Paused",
+		"unique_id":         "fah_" + object + "_paused",
+		"object_id":         "fah_" + object + "_paused",
+		"state_topic":       stateTopic,
+		"value_template":    "{{ 'ON' if value_json.paused else 'OFF' }}",
+		"availability":      p.haAvailability(c),
+		"availability_mode": "all",
+		"device":            device,
+	}
+	p.publishJSON(p.haConfigTopic("binary_sensor", object+"_paused"), paused)
+	for command := range mqttCommands {
+		if !p.cfg.Commands {
+			// Remove buttons retained while commands were enabled
+			p.publish(p.haConfigTopic("button", object+"_"+command), "")
+			continue
+		}
+		p.publishJSON(p.haConfigTopic("button", object+"_"+command), map[string]interface{}{
+			"name":              strings.ToUpper(command[:1]) + command[1:],
+			"unique_id":         "fah_" + object + "_" + command,
+			"object_id":         "fah_" + object + "_" + command,
+			"command_topic":     p.slotTopic(c, slot.ID) + "/set",
+			"payload_press":     command,
+			"availability":      p.haAvailability(c),
+			"availability_mode": "all",
+			"device":            device,
+		})
+	}
+}
+
+// removeSlotDiscovery removes the Home Assistant config of a slot which no longer exists
+func (p *Publisher) removeSlotDiscovery(c *Client, slot string) {
+	object := mqttID(c.Name) + "_" + mqttID(slot)
+	for _, s := range haSlotSensors {
+		p.publish(p.haConfigTopic("sensor", object+"_"+s.key), "")
+	}
+	p.publish(p.haConfigTopic("binary_sensor", object+"_paused"), "")
+	for command := range mqttCommands {
+		p.publish(p.haConfigTopic("button", object+"_"+command), "")
+	}
+}
+
+// publishDonorDiscovery publishes the Home Assistant config of the donor credit of a client
+func (p *Publisher) publishDonorDiscovery(c *Client) {
+	object := mqttID(c.Name) + "_donor_credit"
+	p.publishJSON(p.haConfigTopic("sensor", object), map[string]interface{}{
+		"name":                "Donor credit",
+		"unique_id":           "fah_" + object,
+		"object_id":           "fah_" + object,
+		"state_topic":         p.clientTopic(c) + "/donor",
+		"value_template":      "{{ value_json.credit }}",
+		"unit_of_measurement": "points",
+		"state_class":         "total_increasing",
+		"icon":                "mdi:trophy",
+		"availability":        []map[string]string{{"topic": p.statusTopic()}},
+		"device": map[string]interface{}{
+			"identifiers":  []string{"fah_" + mqttID(c.Name)},
+			"name":         "FAH " + c.Name,
+			"manufacturer": "Folding@home",
+		},
+	})
+}
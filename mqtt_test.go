@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker delivering QoS 0 messages and keeping retained ones
+type testBroker struct {
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mutex    sync.Mutex
+	subs     map[*brokerConn][]string
+	retained map[string][]byte
+}
+
+type brokerConn struct {
+	net.Conn
+	mutex sync.Mutex
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{listener: l, subs: make(map[*brokerConn][]string), retained: make(map[string][]byte)}
+	b.wg.Add(1)
+	go b.serve()
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *testBroker) URL() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) Close() {
+	b.listener.Close()
+	b.mutex.Lock()
+	for c := range b.subs {
+		c.Close()
+	}
+	b.mutex.Unlock()
+	b.wg.Wait()
+}
+
+func (b *testBroker) serve() {
+	defer b.wg.Done()
+	for {
+		nc, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &brokerConn{Conn: nc}
+		b.mutex.Lock()
+		b.subs[c] = nil
+		b.mutex.Unlock()
+		b.wg.Add(1)
+		go b.handle(c)
+	}
+}
+
+func (c *brokerConn) send(header byte, body []byte) {
+	var length []byte
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 128
+		}
+		length = append(length, d)
+		if n == 0 {
+			break
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Write(append(append([]byte{header}, length...), body...))
+}
+
+func mqttString(s string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(len(s))), s...)
+}
+
+func readMQTTString(b []byte) (string, []byte) {
+	n := binary.BigEndian.Uint16(b)
+	return string(b[2 : 2+n]), b[2+n:]
+}
+
+func (b *testBroker) handle(c *brokerConn) {
+	defer b.wg.Done()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.subs, c)
+		b.mutex.Unlock()
+		c.Close()
+	}()
+	r := bufio.NewReader(c)
+	for {
+		header, err := r.ReadByte()
+		if err != nil {
+			return
+		}
+		var length, shift int
+		for {
+			d, err := r.ReadByte()
+			if err != nil {
+				return
+			}
+			length |= int(d&127) << shift
+			shift += 7
+			if d&128 == 0 {
+				break
+			}
+		}
+		body := make([]byte, length)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		switch header >> 4 {
+		case 1: // CONNECT
+			c.send(0x20, []byte{0, 0})
+		case 3: // PUBLISH
+			topic, rest := readMQTTString(body)
+			if qos := header >> 1 & 3; qos > 0 {
+				c.send(0x40, rest[:2])
+				rest = rest[2:]
+			}
+			b.publish(topic, rest, header&1 == 1)
+		case 8: // SUBSCRIBE
+			id, rest := body[:2], body[2:]
+			granted := []byte{}
+			var filters []string
+			for len(rest) > 0 {
+				var filter string
+				filter, rest = readMQTTString(rest)
+				rest = rest[1:]
+				filters = append(filters, filter)
+				granted = append(granted, 0)
+			}
+			b.mutex.Lock()
+			b.subs[c] = append(b.subs[c], filters...)
+			var retained [][]byte
+			for topic, payload := range b.retained {
+				for _, f := range filters {
+					if mqttMatch(f, topic) {
+						retained = append(retained, append(mqttString(topic), payload...))
+						break
+					}
+				}
+			}
+			b.mutex.Unlock()
+			c.send(0x90, append(id, granted...))
+			for _, m := range retained {
+				c.send(0x31, m)
+			}
+		case 10: // UNSUBSCRIBE
+			c.send(0xB0, body[:2])
+		case 12: // PINGREQ
+			c.send(0xD0, nil)
+		case 14: // DISCONNECT
+			return
+		}
+	}
+}
+
+// publish delivers a message to the matching subscriptions, empty retained messages clear the topic
+func (b *testBroker) publish(topic string, payload []byte, retain bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if retain {
+		if len(payload) == 0 {
+			delete(b.retained, topic)
+		} else {
+			b.retained[topic] = append([]byte(nil), payload...)
+		}
+	}
+	for c, filters := range b.subs {
+		for _, f := range filters {
+			if mqttMatch(f, topic) {
+				c.send(0x30, append(mqttString(topic), payload...))
+				break
+			}
+		}
+	}
+}
+
+func (b *testBroker) subscribed(filter string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, filters := range b.subs {
+		for _, f := range filters {
+			if f == filter {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b *testBroker) retainedMessage(topic string) ([]byte, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	payload, ok := b.retained[topic]
+	return payload, ok
+}
+
+func mqttMatch(filter string, topic string) bool {
+	f, t := strings.Split(filter, "/"), strings.Split(topic, "/")
+	for i, part := range f {
+		if part == "#" {
+			return true
+		}
+		if i >= len(t) || (part != "+" && part != t[i]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
+
+// eventually polls cond until it is true or a second passed
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cond()
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	for _, commands := range []bool{false, true} {
+		srv := newTestServer(t)
+		srv.Handle("pause", fahtest.Response{})
+		name := "mqtt-commands"
+		if !commands {
+			name = "mqtt-read-only"
+		}
+		set := NewClientSet(true)
+		if err := set.Add(ClientConfig{Name: name, Address: srv.Addr()}); err != nil {
+			t.Fatal(err)
+		}
+		defer set.remove(name)
+		broker := newTestBroker(t)
+		p, err := NewPublisher(MQTTConfig{Broker: broker.URL(), Commands: commands}, set)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token := p.conn.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		c := set.Get(name)
+		p.publishClient(c, c.Snapshot(0))
+
+		state := "fah/" + name + "/01/state"
+		if !eventually(func() bool { _, ok := broker.retainedMessage(state); return ok }) {
+			t.Fatalf("%s was not published", state)
+		}
+		payload, _ := broker.retainedMessage(state)
+		var st mqttSlotState
+		if err := json.Unmarshal(payload, &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Status != "RUNNING" || st.PPD == nil || *st.PPD != 1683157 {
+			t.Errorf("unexpected slot state %s", payload)
+		}
+		for _, topic := range []string{"fah/status", "fah/" + name + "/availability"} {
+			if payload, _ := broker.retainedMessage(topic); string(payload) != "online" {
+				t.Errorf("%s is %q, want online", topic, payload)
+			}
+		}
+		if _, ok := broker.retainedMessage("homeassistant/sensor/fah-exporter/" + name + "_01_ppd/config"); !ok {
+			t.Error("PPD sensor discovery config was not published")
+		}
+		button := "homeassistant/button/fah-exporter/" + name + "_01_pause/config"
+		if _, ok := broker.retainedMessage(button); ok != commands {
+			t.Errorf("commands %v: pause button published is %v", commands, ok)
+		}
+
+		if commands && !eventually(func() bool { return broker.subscribed("fah/+/+/set") }) {
+			t.Fatal("command topics were not subscribed")
+		}
+		sender := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker.URL()).SetClientID("sender"))
+		if token := sender.Connect(); token.Wait() && token.Error() != nil {
+			t.Fatal(token.Error())
+		}
+		sender.Publish("fah/"+name+"/01/set", 0, false, "pause").Wait()
+		paused := func() bool {
+			for _, cmd := range srv.Commands() {
+				if cmd == "pause 01" {
+					return true
+				}
+			}
+			return false
+		}
+		if commands && !eventually(paused) {
+			t.Error("pause command was not run")
+		}
+		if !commands {
+			time.Sleep(100 * time.Millisecond)
+			if paused() {
+				t.Error("pause command was run although commands are disabled")
+			}
+		}
+		sender.Disconnect(0)
+		p.conn.Disconnect(0)
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Notification types derived from events by the notifier
+const (
+	NotifySlotFailed        = "slot_failed"
+	NotifyClientUnreachable = "client_unreachable"
+	NotifyDonorMilestone    = "donor_milestone"
+)
+
+// Webhook payload formats
+const (
+	formatJSON    = "json"
+	formatSlack   = "slack"
+	formatDiscord = "discord"
+	formatNtfy    = "ntfy"
+)
+
+// NotificationsConfig configures outbound notifications
+type NotificationsConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+	// UnreachableAfter is how long a client must be disconnected before client_unreachable
+	UnreachableAfter time.Duration `yaml:"unreachable_after"`
+	// DonorMilestone sends donor_milestone every time the donor credit passes a multiple of it
+	DonorMilestone int `yaml:"donor_milestone"`
+}
+
+// WebhookConfig is an outbound webhook
+type WebhookConfig struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// Format of the payload: json, slack, discord or ntfy
+	Format string `yaml:"format"`
+	// Events to send, all when empty
+	Events []string `yaml:"events"`
+	// Clients to send events of, all when empty
+	Clients []string `yaml:"clients"`
+	// Template of the message, executed with the Event
+	Template string            `yaml:"template"`
+	Headers  map[string]string `yaml:"headers"`
+	// MaxRetries after the first attempt, backing off exponentially from RetryBackoff, 5 when unset
+	MaxRetries   *int          `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	// DedupWindow drops identical notifications sent within it
+	DedupWindow time.Duration `yaml:"dedup_window"`
+}
+
+const defaultTemplate = "{{ .Message }}"
+
+// Notifier sends events to webhooks
+type Notifier struct {
+	cfg      NotificationsConfig
+	webhooks []*webhook
+	clients  *ClientSet
+
+	mutex        sync.Mutex
+	downSince    map[string]time.Time
+	downNotified map[string]bool
+}
+
+// webhook delivers notifications to a single URL
+type webhook struct {
+	cfg      WebhookConfig
+	template *template.Template
+	events   map[string]bool
+	clients  map[string]bool
+	queue    chan Event
+	// Retries after the first attempt
+	maxRetries int
+	// Time of the last delivery of each notification, for deduplication
+	sent map[string]time.Time
+}
+
+// NewNotifier validates the webhooks and applies defaults, clients already down are
+// taken from the snapshots of set
+func NewNotifier(cfg NotificationsConfig, set *ClientSet) (*Notifier, error) {
+	if cfg.UnreachableAfter == 0 {
+		cfg.UnreachableAfter = 10 * time.Minute
+	}
+	n := &Notifier{
+		cfg:          cfg,
+		clients:      set,
+		downSince:    make(map[string]time.Time),
+		downNotified: make(map[string]bool),
+	}
+	for i, wc := range cfg.Webhooks {
+		if wc.Name == "" {
+			wc.Name = strconv.Itoa(i)
+		}
+		if wc.URL == "" {
+			return nil, fmt.Errorf("webhook %s has no URL", wc.Name)
+		}
+		switch wc.Format {
+		case "":
+			wc.Format = formatJSON
+		case formatJSON, formatSlack, formatDiscord, formatNtfy:
+		default:
+			return nil, fmt.Errorf("webhook %s has unknown format %q", wc.Name, wc.Format)
+		}
+		if wc.Template == "" {
+			wc.Template = defaultTemplate
+		}
+		if wc.RetryBackoff == 0 {
+			wc.RetryBackoff = time.Second
+		}
+		maxRetries := 5
+		if wc.MaxRetries != nil {
+			maxRetries = *wc.MaxRetries
+		}
+		if maxRetries < 0 {
+			return nil, fmt.Errorf("webhook %s has negative max_retries", wc.Name)
+		}
+		if wc.DedupWindow == 0 {
+			wc.DedupWindow = time.Hour
+		}
+		tmpl, err := template.New(wc.Name).Parse(wc.Template)
+		if err != nil {
+			return nil, fmt.Errorf("webhook %s template: %w", wc.Name, err)
+		}
+		n.webhooks = append(n.webhooks, &webhook{
+			cfg:        wc,
+			template:   tmpl,
+			events:     toSet(wc.Events),
+			clients:    toSet(wc.Clients),
+			queue:      make(chan Event, 100),
+			maxRetries: maxRetries,
+			sent:       make(map[string]time.Time),
+		})
+	}
+	return n, nil
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// Run sends the events of hub to the webhooks until the process exits
+func (n *Notifier) Run(hub *EventHub) {
+	for _, w := range n.webhooks {
+		go w.run()
+	}
+	_, ch := hub.Subscribe(^uint64(0))
+	ticker := time.NewTicker(n.cfg.UnreachableAfter / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case e := <-ch:
+			for _, derived := range n.derive(e) {
+				n.dispatch(derived)
+			}
+			n.dispatch(e)
+		case now := <-ticker.C:
+			for _, e := range n.checkUnreachable(now) {
+				n.dispatch(e)
+			}
+		}
+	}
+}
+
+// derive creates the notifications which are not events by themselves
+func (n *Notifier) derive(e Event) []Event {
+	var out []Event
+	switch e.Type {
+	case EventSlotStateChanged:
+		if e.To == "FAILED" {
+			d := e
+			d.Type = NotifySlotFailed
+			d.Message = fmt.Sprintf("slot %s on %s FAILED", e.Slot, e.Client)
+			out = append(out, d)
+		}
+	case EventClientDisconnected:
+		n.mutex.Lock()
+		n.downSince[e.Client] = e.Time
+		n.mutex.Unlock()
+	case EventClientConnected:
+		n.mutex.Lock()
+		delete(n.downSince, e.Client)
+		delete(n.downNotified, e.Client)
+		n.mutex.Unlock()
+	case EventDonorCreditChanged:
+		if n.cfg.DonorMilestone <= 0 {
+			break
+		}
+		from, err1 := strconv.Atoi(e.From)
+		to, err2 := strconv.Atoi(e.To)
+		if err1 != nil || err2 != nil || to/n.cfg.DonorMilestone <= from/n.cfg.DonorMilestone {
+			break
+		}
+		milestone := to / n.cfg.DonorMilestone * n.cfg.DonorMilestone
+		d := e
+		d.Type = NotifyDonorMilestone
+		d.To = strconv.Itoa(milestone)
+		d.Message = fmt.Sprintf("donor passed %d points", milestone)
+		out = append(out, d)
+	}
+	return out
+}
+
+// checkUnreachable creates client_unreachable once for clients disconnected for too long
+func (n *Notifier) checkUnreachable(now time.Time) []Event {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.clients != nil {
+		n.seedDown()
+	}
+	var out []Event
+	for client, since := range n.downSince {
+		if n.downNotified[client] || now.Sub(since) < n.cfg.UnreachableAfter {
+			continue
+		}
+		n.downNotified[client] = true
+		out = append(out, Event{
+			Type:    NotifyClientUnreachable,
+			Time:    now,
+			Client:  client,
+			Message: fmt.Sprintf("client %s unreachable for %s", client, now.Sub(since).Round(time.Second)),
+		})
+	}
+	return out
+}
+
+// seedDown tracks clients whose last collection failed without a client_disconnected event,
+// such as clients down before the notifier started, and forgets removed clients.
+// The caller must hold the lock.
+func (n *Notifier) seedDown() {
+	current := make(map[string]bool)
+	for _, c := range n.clients.All() {
+		current[c.Name] = true
+		if _, ok := n.downSince[c.Name]; ok {
+			continue
+		}
+		if s := c.lastSnapshot(); s.Error != nil {
+			n.downSince[c.Name] = s.DownSince
+		}
+	}
+	for client := range n.downSince {
+		if !current[client] {
+			delete(n.downSince, client)
+			delete(n.downNotified, client)
+		}
+	}
+}
+
+// dispatch queues the notification on every webhook accepting it
+func (n *Notifier) dispatch(e Event) {
+	for _, w := range n.webhooks {
+		if len(w.events) > 0 && !w.events[e.Type] {
+			continue
+		}
+		if len(w.clients) > 0 && !w.clients[e.Client] {
+			continue
+		}
+		select {
+		case w.queue <- e:
+		default:
+			log.Warnf("Webhook %s queue is full, dropping %s", w.cfg.Name, e.Type)
+		}
+	}
+}
+
+// dedupKey identifies identical notifications
+func dedupKey(e Event) string {
+	return strings.Join([]string{e.Type, e.Client, e.Slot, e.Queue, e.Unit, e.To}, "|")
+}
+
+func (w *webhook) run() {
+	for e := range w.queue {
+		key := dedupKey(e)
+		if last, ok := w.sent[key]; ok && time.Since(last) < w.cfg.DedupWindow {
+			log.Debugf("Webhook %s skipping duplicate %s", w.cfg.Name, e.Type)
+			continue
+		}
+		if err := w.deliver(e); err != nil {
+			log.Errorf("Webhook %s failed to send %s: %v", w.cfg.Name, e.Type, err)
+			continue
+		}
+		w.sent[key] = time.Now()
+		for k, t := range w.sent {
+			if time.Since(t) >= w.cfg.DedupWindow {
+				delete(w.sent, k)
+			}
+		}
+	}
+}
+
+// deliver sends a notification, retrying with exponential backoff
+func (w *webhook) deliver(e Event) error {
+	body, contentType, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+	backoff := w.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(e, body, contentType)
+		if err == nil || attempt >= w.maxRetries {
+			return err
+		}
+		log.Debugf("Webhook %s attempt %d failed, retrying in %s: %v", w.cfg.Name, attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (w *webhook) post(e Event, body []byte, contentType string) error {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if w.cfg.Format == formatNtfy {
+		req.Header.Set("Title", "FAH "+strings.ReplaceAll(e.Type, "_", " "))
+		req.Header.Set("Tags", e.Type)
+	}
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := myClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// payload renders the message and encodes it in the webhook format
+func (w *webhook) payload(e Event) ([]byte, string, error) {
+	var msg bytes.Buffer
+	if err := w.template.Execute(&msg, e); err != nil {
+		return nil, "", err
+	}
+	var v interface{}
+	switch w.cfg.Format {
+	case formatSlack:
+		v = map[string]string{"text": msg.String()}
+	case formatDiscord:
+		v = map[string]string{"content": msg.String()}
+	case formatNtfy:
+		return msg.Bytes(), "text/plain; charset=utf-8", nil
+	default:
+		e.Message = msg.String()
+		v = e
+	}
+	body, err := json.Marshal(v)
+	return body, "application/json", err
+}
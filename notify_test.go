@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+)
+
+// webhookReceiver records the requests of a webhook, failing the first failures requests
+type webhookReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	failures int
+	bodies   []string
+	times    []time.Time
+}
+
+func newWebhookReceiver(t *testing.T, failures int) *webhookReceiver {
+	r := &webhookReceiver{failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.bodies = append(r.bodies, string(body))
+		r.times = append(r.times, time.Now())
+		if len(r.bodies) <= r.failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *webhookReceiver) requests() ([]string, []time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]string(nil), r.bodies...), append([]time.Time(nil), r.times...)
+}
+
+func newTestWebhook(t *testing.T, wc WebhookConfig) *webhook {
+	t.Helper()
+	n, err := NewNotifier(NotificationsConfig{Webhooks: []WebhookConfig{wc}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n.webhooks[0]
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	e := Event{ID: 3, Type: EventUnitFinished, Client: "desktop", Slot: "01", Message: "unit finished"}
+	for _, tc := range []struct {
+		format, template, want string
+	}{
+		{formatSlack, "", `{"text":"unit finished"}`},
+		{formatDiscord, "{{ .Client }}: {{ .Message }}", `{"content":"desktop: unit finished"}`},
+		{formatNtfy, "", "unit finished"},
+	} {
+		r := newWebhookReceiver(t, 0)
+		w := newTestWebhook(t, WebhookConfig{URL: r.URL, Format: tc.format, Template: tc.template})
+		if err := w.deliver(e); err != nil {
+			t.Fatalf("%s: %v", tc.format, err)
+		}
+		if bodies, _ := r.requests(); len(bodies) != 1 || bodies[0] != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.format, bodies, tc.want)
+		}
+	}
+
+	r := newWebhookReceiver(t, 0)
+	w := newTestWebhook(t, WebhookConfig{URL: r.URL})
+	if err := w.deliver(e); err != nil {
+		t.Fatal(err)
+	}
+	bodies, _ := r.requests()
+	var got Event
+	if err := json.Unmarshal([]byte(bodies[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != e.Type || got.Client != e.Client || got.Slot != e.Slot || got.Message != e.Message {
+		t.Errorf("got event %+v, want %+v", got, e)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	retries := func(n int) *int { return &n }
+	for _, tc := range []struct {
+		name       string
+		maxRetries *int
+		failures   int
+		requests   int
+		fails      bool
+	}{
+		{"succeeds after retries", retries(3), 2, 3, false},
+		{"gives up", retries(2), 5, 3, true},
+		{"retries disabled", retries(0), 1, 1, true},
+		{"default retries", nil, 5, 6, false},
+	} {
+		r := newWebhookReceiver(t, tc.failures)
+		w := newTestWebhook(t, WebhookConfig{URL: r.URL, MaxRetries: tc.maxRetries, RetryBackoff: 5 * time.Millisecond})
+		err := w.deliver(Event{Type: EventUnitFinished})
+		if (err != nil) != tc.fails {
+			t.Errorf("%s: got error %v", tc.name, err)
+		}
+		bodies, times := r.requests()
+		if len(bodies) != tc.requests {
+			t.Errorf("%s: got %d requests, want %d", tc.name, len(bodies), tc.requests)
+		}
+		// The backoff doubles after every attempt
+		backoff := 5 * time.Millisecond
+		for i := 1; i < len(times); i++ {
+			if d := times[i].Sub(times[i-1]); d < backoff {
+				t.Errorf("%s: retry %d after %s, want at least %s", tc.name, i, d, backoff)
+			}
+			backoff *= 2
+		}
+	}
+}
+
+func TestWebhookNegativeRetries(t *testing.T) {
+	n := -1
+	if _, err := NewNotifier(NotificationsConfig{Webhooks: []WebhookConfig{{URL: "http://localhost", MaxRetries: &n}}}, nil); err == nil {
+		t.Error("negative max_retries is accepted")
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	n, err := NewNotifier(NotificationsConfig{UnreachableAfter: time.Minute}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := time.Now()
+	n.derive(Event{Type: EventClientDisconnected, Client: "desktop", Time: down})
+	if got := n.checkUnreachable(down.Add(30 * time.Second)); len(got) != 0 {
+		t.Errorf("unreachable before the timeout: %v", got)
+	}
+	got := n.checkUnreachable(down.Add(time.Minute))
+	if len(got) != 1 || got[0].Type != NotifyClientUnreachable || got[0].Client != "desktop" {
+		t.Fatalf("got %v, want client_unreachable for desktop", got)
+	}
+	// Sent once until the client connects again
+	if got := n.checkUnreachable(down.Add(2 * time.Minute)); len(got) != 0 {
+		t.Errorf("unreachable sent again: %v", got)
+	}
+	n.derive(Event{Type: EventClientConnected, Client: "desktop", Time: down.Add(3 * time.Minute)})
+	n.derive(Event{Type: EventClientDisconnected, Client: "desktop", Time: down.Add(4 * time.Minute)})
+	if got := n.checkUnreachable(down.Add(5 * time.Minute)); len(got) != 1 {
+		t.Errorf("got %v after reconnecting, want client_unreachable", got)
+	}
+}
+
+func TestUnreachableAtStartup(t *testing.T) {
+	srv := fahtest.NewServer()
+	address := srv.Addr()
+	srv.Close()
+	set := NewClientSet(true)
+	if err := set.Add(ClientConfig{Name: "notify-down", Address: address}); err != nil {
+		t.Fatal(err)
+	}
+	defer set.remove("notify-down")
+	// The client is down before the notifier subscribes to events
+	set.Get("notify-down").Collect()
+	n, err := NewNotifier(NotificationsConfig{UnreachableAfter: time.Minute}, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := n.checkUnreachable(time.Now()); len(got) != 0 {
+		t.Errorf("unreachable before the timeout: %v", got)
+	}
+	got := n.checkUnreachable(time.Now().Add(time.Minute))
+	if len(got) != 1 || got[0].Client != "notify-down" {
+		t.Errorf("got %v, want client_unreachable for notify-down", got)
+	}
+}
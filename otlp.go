@@ -0,0 +1,367 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLP protocols
+const (
+	otlpHTTP = "http/protobuf"
+	otlpGRPC = "grpc"
+)
+
+const otlpGRPCPath = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// OTLPConfig configures exporting the metrics to an OpenTelemetry collector
+type OTLPConfig struct {
+	// Endpoint is the collector URL, for example http://localhost:4318 for http/protobuf or
+	// http://localhost:4317 for grpc, use https:// for TLS
+	Endpoint string `yaml:"endpoint"`
+	// Protocol is http/protobuf or grpc
+	Protocol    string            `yaml:"protocol"`
+	Headers     map[string]string `yaml:"headers"`
+	RetryConfig `yaml:",inline"`
+	// ResourceAttributes are added to the resource of every client
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+	Interval           time.Duration     `yaml:"interval"`
+}
+
+// OTLPExporter periodically exports the metrics of every client as an OTLP resource
+type OTLPExporter struct {
+	cfg      OTLPConfig
+	gatherer prometheus.Gatherer
+	clients  *ClientSet
+	url      string
+	http     *http.Client
+	start    time.Time
+
+	mutex sync.Mutex
+	// FAH client versions read from the info command
+	versions map[string]string
+}
+
+// NewOTLPExporter validates the configuration and applies defaults
+func NewOTLPExporter(cfg OTLPConfig, gatherer prometheus.Gatherer, clients *ClientSet) (*OTLPExporter, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = otlpHTTP
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	cfg.setDefaults()
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q, use http:// or https://", cfg.Endpoint)
+	}
+	e := &OTLPExporter{
+		cfg:      cfg,
+		gatherer: gatherer,
+		clients:  clients,
+		start:    time.Now(),
+		versions: make(map[string]string),
+	}
+	switch cfg.Protocol {
+	case otlpHTTP:
+		if !strings.HasSuffix(u.Path, "/v1/metrics") {
+			u = u.JoinPath("v1", "metrics")
+		}
+		e.http = myClient
+	case otlpGRPC:
+		u.Path = otlpGRPCPath
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			// gRPC without TLS uses HTTP/2 with prior knowledge
+			transport.AllowHTTP = true
+			transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		e.http = &http.Client{Transport: transport, Timeout: myClient.Timeout}
+	default:
+		return nil, fmt.Errorf("unsupported OTLP protocol %q, use %s or %s", cfg.Protocol, otlpHTTP, otlpGRPC)
+	}
+	e.url = u.String()
+	return e, nil
+}
+
+// Run exports the metrics every interval until the process exits
+func (e *OTLPExporter) Run() {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		body := e.request(gatherFAH(e.gatherer, "OTLP"), time.Now())
+		if err := retry("OTLP", e.cfg.RetryConfig, func() error { return e.send(body) }); err != nil {
+			log.Errorf("Cannot export metrics with OTLP: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+// version returns the FAH client version, read once per client
+func (e *OTLPExporter) version(c *Client) string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if v, ok := e.versions[c.Name]; ok {
+		return v
+	}
+	sections, err := c.Info()
+	if err != nil {
+		return ""
+	}
+	for _, s := range sections {
+		if s.Name != "FAHClient" {
+			continue
+		}
+		for _, kv := range s.Values {
+			if kv[0] == "Version" {
+				e.versions[c.Name] = kv[1]
+				return kv[1]
+			}
+		}
+	}
+	return ""
+}
+
+// resource returns the resource attributes of a client, or of the exporter itself when c is nil
+func (e *OTLPExporter) resource(c *Client) map[string]string {
+	attrs := map[string]string{"service.name": "fah-exporter"}
+	if c != nil {
+		e.clientAttributes(attrs, c)
+	}
+	for k, v := range e.cfg.ResourceAttributes {
+		attrs[k] = v
+	}
+	return attrs
+}
+
+// clientAttributes adds the attributes identifying a client
+func (e *OTLPExporter) clientAttributes(attrs map[string]string, c *Client) {
+	attrs["fah.client.name"] = c.Name
+	attrs["fah.client.address"] = privacy.Apply(fieldAddress, c.Address)
+	host, _, err := net.SplitHostPort(c.Address)
+	if err != nil {
+		host = c.Address
+	}
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		host, _ = os.Hostname()
+	}
+	host = privacy.Apply(fieldAddress, host)
+	if host != "" {
+		attrs["host.name"] = host
+	}
+	if v := e.version(c); v != "" {
+		attrs["fah.client.version"] = v
+	}
+}
+
+// request encodes an ExportMetricsServiceRequest with one resource per client, metrics
+// without a client label such as the fleet aggregates are in a resource of the exporter
+func (e *OTLPExporter) request(families []*dto.MetricFamily, now time.Time) []byte {
+	var req []byte
+	for _, c := range e.clients.All() {
+		req = e.appendResourceMetrics(req, e.resource(c), clientFamilies(families, c.Name), now)
+	}
+	if exporter := clientFamilies(families, ""); len(exporter) > 0 {
+		req = e.appendResourceMetrics(req, e.resource(nil), exporter, now)
+	}
+	return req
+}
+
+// appendResourceMetrics appends a ResourceMetrics message with the families in one scope
+func (e *OTLPExporter) appendResourceMetrics(req []byte, attrs map[string]string, families []*dto.MetricFamily, now time.Time) []byte {
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendBytes(scope, otlpScope())
+	for _, mf := range families {
+		if m := otlpMetric(mf, e.start, now); m != nil {
+			scope = protowire.AppendTag(scope, 2, protowire.BytesType)
+			scope = protowire.AppendBytes(scope, m)
+		}
+	}
+	var rm []byte
+	rm = protowire.AppendTag(rm, 1, protowire.BytesType)
+	rm = protowire.AppendBytes(rm, otlpAttributes(nil, 1, attrs))
+	rm = protowire.AppendTag(rm, 2, protowire.BytesType)
+	rm = protowire.AppendBytes(rm, scope)
+	req = protowire.AppendTag(req, 1, protowire.BytesType)
+	return protowire.AppendBytes(req, rm)
+}
+
+func otlpScope() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, "github.com/cosandr/fah-exporter")
+	return b
+}
+
+// otlpAttributes appends the attributes as KeyValue string messages in field num, sorted by key
+func otlpAttributes(b []byte, num protowire.Number, attrs map[string]string) []byte {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, attrs[k])
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, k)
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		kv = protowire.AppendBytes(kv, value)
+		b = protowire.AppendTag(b, num, protowire.BytesType)
+		b = protowire.AppendBytes(b, kv)
+	}
+	return b
+}
+
+// otlpMetric converts a gauge to an OTLP Gauge and a counter to a cumulative monotonic Sum
+func otlpMetric(mf *dto.MetricFamily, start time.Time, now time.Time) []byte {
+	var points []byte
+	for _, m := range mf.GetMetric() {
+		value, ok := sampleValue(m)
+		if !ok {
+			continue
+		}
+		attrs := make(map[string]string, len(m.GetLabel()))
+		for _, l := range m.GetLabel() {
+			attrs[l.GetName()] = l.GetValue()
+		}
+		var p []byte
+		p = protowire.AppendTag(p, 2, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, uint64(start.UnixNano()))
+		p = protowire.AppendTag(p, 3, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, uint64(now.UnixNano()))
+		p = protowire.AppendTag(p, 4, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, math.Float64bits(value))
+		p = otlpAttributes(p, 7, attrs)
+		points = protowire.AppendTag(points, 1, protowire.BytesType)
+		points = protowire.AppendBytes(points, p)
+	}
+	if len(points) == 0 {
+		return nil
+	}
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.BytesType)
+	b = protowire.AppendString(b, mf.GetName())
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, mf.GetHelp())
+	if strings.HasSuffix(mf.GetName(), "_seconds") {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendString(b, "s")
+	}
+	if mf.GetType() == dto.MetricType_COUNTER {
+		// Cumulative aggregation temporality
+		points = protowire.AppendTag(points, 2, protowire.VarintType)
+		points = protowire.AppendVarint(points, 2)
+		points = protowire.AppendTag(points, 3, protowire.VarintType)
+		points = protowire.AppendVarint(points, 1)
+		b = protowire.AppendTag(b, 7, protowire.BytesType)
+	} else {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+	}
+	return protowire.AppendBytes(b, points)
+}
+
+// send exports the request, errors which cannot succeed when retried are permanent
+func (e *OTLPExporter) send(body []byte) error {
+	if e.cfg.Protocol == otlpGRPC {
+		return e.sendGRPC(body)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return err
+	}
+	return permanentError{err}
+}
+
+// sendGRPC calls MetricsService/Export with the request as a length-prefixed gRPC message
+func (e *OTLPExporter) sendGRPC(body []byte) error {
+	msg := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(msg[1:], uint32(len(body)))
+	msg = append(msg, body...)
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Trailers are only available after reading the body
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		// Trailers-only responses carry the status in the headers
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		return fmt.Errorf("invalid gRPC status %q", status)
+	}
+	if code == 0 {
+		return nil
+	}
+	if m, err := url.PathUnescape(message); err == nil {
+		message = m
+	}
+	err = fmt.Errorf("gRPC status %d: %s", code, message)
+	switch code {
+	// Cancelled, deadline exceeded, resource exhausted, aborted, out of range, unavailable and data loss
+	case 1, 4, 8, 10, 11, 14, 15:
+		return err
+	}
+	return permanentError{err}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpAttributeMap converts OTLP string attributes to a map
+func otlpAttributeMap(kvs []*commonpb.KeyValue) map[string]string {
+	attrs := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		attrs[kv.GetKey()] = kv.GetValue().GetStringValue()
+	}
+	return attrs
+}
+
+func TestOTLPRequest(t *testing.T) {
+	srv := newTestServer(t)
+	name := "otlp-desktop"
+	set := NewClientSet(true)
+	if err := set.Add(ClientConfig{Name: name, Address: srv.Addr()}); err != nil {
+		t.Fatal(err)
+	}
+	defer set.remove(name)
+	reg := prometheus.NewPedanticRegistry()
+	prometheus.WrapRegistererWith(prometheus.Labels{"client": name}, reg).MustRegister(NewExporter(set.Get(name)))
+	reg.MustRegister(NewFleetCollector(set), eventsDropped)
+
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/x-protobuf" || r.Header.Get("X-Token") != "secret" {
+			t.Errorf("unexpected request %s %s %v", r.Method, r.URL.Path, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		bodies <- body
+	}))
+	defer receiver.Close()
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:           receiver.URL,
+		Headers:            map[string]string{"X-Token": "secret"},
+		ResourceAttributes: map[string]string{"deployment.environment": "test"},
+	}, reg, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.send(e.request(gatherFAH(reg, "OTLP"), time.Now())); err != nil {
+		t.Fatal(err)
+	}
+
+	// ExportMetricsServiceRequest has the same encoding as MetricsData
+	var req metricspb.MetricsData
+	if err := proto.Unmarshal(<-bodies, &req); err != nil {
+		t.Fatal(err)
+	}
+	resources := req.GetResourceMetrics()
+	if len(resources) != 2 {
+		t.Fatalf("got %d resources, want the client and the exporter", len(resources))
+	}
+	hostname, _ := os.Hostname()
+	client := map[string]string{
+		"service.name":           "fah-exporter",
+		"host.name":              hostname,
+		"fah.client.name":        name,
+		"fah.client.address":     srv.Addr(),
+		"fah.client.version":     "7.6.21",
+		"deployment.environment": "test",
+	}
+	if attrs := otlpAttributeMap(resources[0].GetResource().GetAttributes()); !reflect.DeepEqual(attrs, client) {
+		t.Errorf("client resource %v, want %v", attrs, client)
+	}
+	exporter := map[string]string{"service.name": "fah-exporter", "deployment.environment": "test"}
+	if attrs := otlpAttributeMap(resources[1].GetResource().GetAttributes()); !reflect.DeepEqual(attrs, exporter) {
+		t.Errorf("exporter resource %v, want %v", attrs, exporter)
+	}
+
+	metrics := make(map[string]*metricspb.Metric)
+	for i, rm := range resources {
+		if len(rm.GetScopeMetrics()) != 1 || rm.GetScopeMetrics()[0].GetScope().GetName() != "github.com/cosandr/fah-exporter" {
+			t.Fatalf("resource %d has unexpected scopes %v", i, rm.GetScopeMetrics())
+		}
+		for _, m := range rm.GetScopeMetrics()[0].GetMetrics() {
+			fleet := strings.HasPrefix(m.GetName(), "fah_fleet_") || m.GetName() == "fah_events_dropped_total"
+			if fleet != (i == 1) {
+				t.Errorf("%s is in resource %d", m.GetName(), i)
+			}
+			metrics[m.GetName()] = m
+		}
+	}
+
+	up := metrics["fah_up"]
+	if up.GetDescription() != "FAH Metric Collection Operational" || len(up.GetGauge().GetDataPoints()) != 1 {
+		t.Fatalf("unexpected fah_up %v", up)
+	}
+	point := up.GetGauge().GetDataPoints()[0]
+	if point.GetAsDouble() != 1 || len(point.GetAttributes()) != 0 || point.GetTimeUnixNano() <= point.GetStartTimeUnixNano() {
+		t.Errorf("unexpected fah_up point %v", point)
+	}
+	ppd := metrics["fah_ppd"].GetGauge().GetDataPoints()
+	if len(ppd) == 0 {
+		t.Error("fah_ppd has no data points")
+	}
+	for _, p := range ppd {
+		attrs := otlpAttributeMap(p.GetAttributes())
+		if attrs["slot"] == "" || attrs["queue"] == "" || attrs["client"] != "" {
+			t.Errorf("unexpected fah_ppd attributes %v", attrs)
+		}
+	}
+	seconds := 0
+	for name, m := range metrics {
+		if strings.HasSuffix(name, "_seconds") {
+			seconds++
+			if m.GetUnit() != "s" {
+				t.Errorf("%s has unit %q, want s", name, m.GetUnit())
+			}
+		}
+	}
+	if seconds == 0 {
+		t.Error("no metric in seconds was exported")
+	}
+	sum := metrics["fah_events_dropped_total"].GetSum()
+	if sum == nil || !sum.GetIsMonotonic() || sum.GetAggregationTemporality() != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE {
+		t.Errorf("fah_events_dropped_total is not a cumulative monotonic sum: %v", metrics["fah_events_dropped_total"])
+	}
+}
+
+func TestOTLPGRPC(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(eventsDropped)
+	var status, trailersOnly string
+	requests := make(chan *metricspb.MetricsData, 1)
+	receiver := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != otlpGRPCPath || r.Header.Get("Content-Type") != "application/grpc" || r.Header.Get("X-Token") != "secret" {
+			t.Errorf("unexpected request %s %s %s %v", r.Proto, r.Method, r.URL.Path, r.Header)
+		}
+		body, _ := io.ReadAll(r.Body)
+		// Uncompressed messages are prefixed with a zero byte and their big endian length
+		if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:5])) != len(body)-5 {
+			t.Errorf("invalid gRPC message framing % x", body[:5])
+			return
+		}
+		var req metricspb.MetricsData
+		if err := proto.Unmarshal(body[5:], &req); err != nil {
+			t.Error(err)
+		}
+		requests <- &req
+		w.Header().Set("Content-Type", "application/grpc")
+		if trailersOnly != "" {
+			w.Header().Set("Grpc-Status", trailersOnly)
+			w.Header().Set("Grpc-Message", "trailers%20only")
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+		// An empty ExportMetricsServiceResponse
+		w.Write([]byte{0, 0, 0, 0, 0})
+		w.Header().Set("Grpc-Status", status)
+		w.Header().Set("Grpc-Message", "status%20"+status)
+	}), &http2.Server{}))
+	defer receiver.Close()
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint: receiver.URL,
+		Protocol: otlpGRPC,
+		Headers:  map[string]string{"X-Token": "secret"},
+	}, reg, NewClientSet(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		status, trailersOnly string
+		err                  string
+		permanent            bool
+	}{
+		{status: "0"},
+		{status: "14", err: "gRPC status 14: status 14"},
+		{status: "3", err: "gRPC status 3: status 3", permanent: true},
+		{trailersOnly: "8", err: "gRPC status 8: trailers only"},
+	} {
+		status, trailersOnly = tc.status, tc.trailersOnly
+		err := e.send(e.request(gatherFAH(reg, "OTLP"), time.Now()))
+		req := <-requests
+		if names := req.GetResourceMetrics()[0].GetScopeMetrics()[0].GetMetrics(); len(names) != 1 || names[0].GetName() != "fah_events_dropped_total" {
+			t.Errorf("unexpected metrics %v", names)
+		}
+		var perm permanentError
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("status %s%s: %v", tc.status, tc.trailersOnly, err)
+		case tc.err != "" && (err == nil || err.Error() != tc.err):
+			t.Errorf("status %s%s: got error %v, want %s", tc.status, tc.trailersOnly, err, tc.err)
+		case err != nil && errors.As(err, &perm) != tc.permanent:
+			t.Errorf("status %s%s: permanent %v, want %v", tc.status, tc.trailersOnly, !tc.permanent, tc.permanent)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sysfsPath is the mount point of sysfs, changed to read a fake tree
+var sysfsPath = "/sys"
+
+// Power source types
+const (
+	powerRAPL   = "rapl"
+	powerHwmon  = "hwmon"
+	powerStatic = "static"
+)
+
+// PowerSource is a power measurement or estimate of a client host or one of its slots
+type PowerSource struct {
+	// Type is rapl, hwmon or static
+	Type string `yaml:"type"`
+	// Slot the measured power belongs to, the whole host when empty
+	Slot string `yaml:"slot"`
+	// Zone is a glob of the RAPL zone names to sum, package-* by default
+	Zone string `yaml:"zone"`
+	// Sensor is the name of the hwmon device, such as amdgpu
+	Sensor string `yaml:"sensor"`
+	// Description is a glob of the slot descriptions a static wattage applies to, such as gpu:*
+	Description string `yaml:"description"`
+	// Watts of running slots and IdleWatts of the others, for static sources
+	Watts     float64 `yaml:"watts"`
+	IdleWatts float64 `yaml:"idle_watts"`
+}
+
+// powerReading is the power of a slot, or the host when Slot is empty
+type powerReading struct {
+	Slot   string
+	Source string
+	Watts  float64
+}
+
+// raplSample is a previous energy counter reading, RAPL only exposes energy
+type raplSample struct {
+	energy float64
+	time   time.Time
+}
+
+// PowerMeter reads the power sources of a client
+type PowerMeter struct {
+	sources []PowerSource
+
+	mutex sync.Mutex
+	rapl  map[string]raplSample
+}
+
+// NewPowerMeter validates the power sources and applies defaults
+func NewPowerMeter(sources []PowerSource) (*PowerMeter, error) {
+	for i := range sources {
+		s := &sources[i]
+		switch s.Type {
+		case powerRAPL:
+			if s.Zone == "" {
+				s.Zone = "package-*"
+			}
+		case powerHwmon:
+			if s.Sensor == "" {
+				return nil, fmt.Errorf("hwmon power source %d has no sensor", i)
+			}
+		case powerStatic:
+			if s.Description == "" {
+				return nil, fmt.Errorf("static power source %d has no description", i)
+			}
+		default:
+			return nil, fmt.Errorf("unknown power source type %q", s.Type)
+		}
+	}
+	return &PowerMeter{sources: sources, rapl: make(map[string]raplSample)}, nil
+}
+
+// Read returns the power of every source, slots are matched against static sources
+func (m *PowerMeter) Read(slots []SlotInfo) ([]powerReading, error) {
+	var (
+		readings []powerReading
+		errs     []string
+	)
+	for _, s := range m.sources {
+		switch s.Type {
+		case powerRAPL:
+			w, err := m.readRAPL(s.Zone)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			readings = append(readings, powerReading{Slot: s.Slot, Source: powerRAPL, Watts: w})
+		case powerHwmon:
+			w, err := readHwmon(s.Sensor)
+			if err != nil {
+				errs = append(errs, err.Error())
+				continue
+			}
+			readings = append(readings, powerReading{Slot: s.Slot, Source: powerHwmon, Watts: w})
+		case powerStatic:
+			for _, slot := range slots {
+				if ok, _ := path.Match(s.Description, slot.Description); !ok {
+					continue
+				}
+				w := s.IdleWatts
+				if slot.Status == "RUNNING" {
+					w = s.Watts
+				}
+				readings = append(readings, powerReading{Slot: slot.ID, Source: powerStatic, Watts: w})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return readings, fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return readings, nil
+}
+
+// readRAPL returns the average power of the matching top-level RAPL zones since the previous
+// reading, the first reading samples the counters twice
+func (m *PowerMeter) readRAPL(pattern string) (float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	zones, err := filepath.Glob(filepath.Join(sysfsPath, "class/powercap/intel-rapl:*"))
+	if err != nil {
+		return 0, err
+	}
+	var (
+		watts   float64
+		matched bool
+	)
+	for _, zone := range zones {
+		// Subzones such as intel-rapl:0:0 are included in their package
+		if strings.Count(filepath.Base(zone), ":") != 1 {
+			continue
+		}
+		name, err := readSysfsString(filepath.Join(zone, "name"))
+		if err != nil {
+			return 0, err
+		}
+		if ok, _ := path.Match(pattern, name); !ok {
+			continue
+		}
+		matched = true
+		prev, ok := m.rapl[zone]
+		if !ok {
+			if prev, err = readRAPLSample(zone); err != nil {
+				return 0, err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		cur, err := readRAPLSample(zone)
+		if err != nil {
+			return 0, err
+		}
+		m.rapl[zone] = cur
+		delta := cur.energy - prev.energy
+		if delta < 0 {
+			// The counter wrapped around
+			max, err := readSysfsFloat(filepath.Join(zone, "max_energy_range_uj"))
+			if err != nil {
+				return 0, err
+			}
+			delta += max
+		}
+		if elapsed := cur.time.Sub(prev.time).Seconds(); elapsed > 0 {
+			watts += delta / 1e6 / elapsed
+		}
+	}
+	if !matched {
+		return 0, fmt.Errorf("no RAPL zone matches %q", pattern)
+	}
+	return watts, nil
+}
+
+func readRAPLSample(zone string) (raplSample, error) {
+	energy, err := readSysfsFloat(filepath.Join(zone, "energy_uj"))
+	return raplSample{energy: energy, time: time.Now()}, err
+}
+
+// readHwmon returns the power of the first power sensor of the named hwmon device,
+// averaged readings are preferred over instantaneous ones
+func readHwmon(sensor string) (float64, error) {
+	devices, err := filepath.Glob(filepath.Join(sysfsPath, "class/hwmon/hwmon*"))
+	if err != nil {
+		return 0, err
+	}
+	sort.Strings(devices)
+	for _, dev := range devices {
+		name, err := readSysfsString(filepath.Join(dev, "name"))
+		if err != nil || name != sensor {
+			continue
+		}
+		for _, pattern := range []string{"power*_average", "power*_input"} {
+			files, _ := filepath.Glob(filepath.Join(dev, pattern))
+			sort.Strings(files)
+			if len(files) == 0 {
+				continue
+			}
+			uw, err := readSysfsFloat(files[0])
+			if err != nil {
+				return 0, err
+			}
+			return uw / 1e6, nil
+		}
+		return 0, fmt.Errorf("hwmon %s has no power sensor", sensor)
+	}
+	return 0, fmt.Errorf("no hwmon device named %s", sensor)
+}
+
+func readSysfsString(file string) (string, error) {
+	b, err := os.ReadFile(file)
+	return strings.TrimSpace(string(b)), err
+}
+
+func readSysfsFloat(file string) (float64, error) {
+	s, err := readSysfsString(file)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// slotPPD returns the PPD of every slot and of the whole client under the empty slot
+func slotPPD(queues []QueueInfo) map[string]float64 {
+	ppd := map[string]float64{"": 0}
+	for _, q := range queues {
+		if v := parseNumber(q.Ppd); v != nil {
+			ppd[q.Slot] += *v
+			ppd[""] += *v
+		}
+	}
+	return ppd
+}
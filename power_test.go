@@ -0,0 +1,127 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeSysfs creates a fake sysfs tree from file contents by path and reads from it during the test
+func writeSysfs(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		file := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, []byte(content+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := sysfsPath
+	sysfsPath = root
+	t.Cleanup(func() { sysfsPath = saved })
+	return root
+}
+
+func TestReadRAPL(t *testing.T) {
+	const maxEnergy = 262143328850
+	root := writeSysfs(t, map[string]string{
+		"class/powercap/intel-rapl:0/name":                  "package-0",
+		"class/powercap/intel-rapl:0/energy_uj":             "1000000",
+		"class/powercap/intel-rapl:0/max_energy_range_uj":   "262143328850",
+		"class/powercap/intel-rapl:0:0/name":                "core",
+		"class/powercap/intel-rapl:0:0/energy_uj":           "500000",
+		"class/powercap/intel-rapl:0:0/max_energy_range_uj": "262143328850",
+	})
+	zone := filepath.Join(root, "class/powercap/intel-rapl:0")
+	setEnergy := func(uj string) {
+		if err := os.WriteFile(filepath.Join(zone, "energy_uj"), []byte(uj+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m, err := NewPowerMeter([]PowerSource{{Type: powerRAPL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first reading samples the counter twice, the counter did not change in between
+	start := time.Now()
+	w, err := m.readRAPL("package-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("first reading took %s, want a second sample after 100ms", elapsed)
+	}
+	if w != 0 {
+		t.Errorf("first reading got %v W, want 0", w)
+	}
+	// Subzones are not sampled
+	if len(m.rapl) != 1 {
+		t.Errorf("sampled zones %v, want only %s", m.rapl, zone)
+	}
+	if _, err := m.readRAPL("core"); err == nil || !strings.Contains(err.Error(), "no RAPL zone") {
+		t.Errorf("subzone pattern got error %v", err)
+	}
+
+	cases := []struct {
+		name string
+		prev float64
+		cur  string
+	}{
+		{"increasing", 1e6, "101000000"},
+		{"wraparound", maxEnergy - 50e6, "50000000"},
+	}
+	for _, c := range cases {
+		// 100 J over 10 s
+		m.rapl[zone] = raplSample{energy: c.prev, time: time.Now().Add(-10 * time.Second)}
+		setEnergy(c.cur)
+		w, err := m.readRAPL("package-*")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if math.Abs(w-10) > 0.1 {
+			t.Errorf("%s: got %v W, want 10", c.name, w)
+		}
+	}
+}
+
+func TestReadHwmon(t *testing.T) {
+	writeSysfs(t, map[string]string{
+		"class/hwmon/hwmon0/name":           "coretemp",
+		"class/hwmon/hwmon0/temp1_input":    "45000",
+		"class/hwmon/hwmon1/name":           "amdgpu",
+		"class/hwmon/hwmon1/power1_average": "150000000",
+		"class/hwmon/hwmon1/power1_input":   "200000000",
+		"class/hwmon/hwmon2/name":           "nvme",
+		"class/hwmon/hwmon2/power1_input":   "5000000",
+	})
+	cases := []struct {
+		sensor string
+		watts  float64
+		err    string
+	}{
+		{sensor: "amdgpu", watts: 150},
+		{sensor: "nvme", watts: 5},
+		{sensor: "coretemp", err: "hwmon coretemp has no power sensor"},
+		{sensor: "nouveau", err: "no hwmon device named nouveau"},
+	}
+	for _, c := range cases {
+		w, err := readHwmon(c.sensor)
+		if c.err != "" {
+			if err == nil || err.Error() != c.err {
+				t.Errorf("%s: got error %v, want %s", c.sensor, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", c.sensor, err)
+		} else if w != c.watts {
+			t.Errorf("%s: got %v W, want %v", c.sensor, w, c.watts)
+		}
+	}
+}
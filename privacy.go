@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Fields which can be redacted
+const (
+	fieldUser        = "user"
+	fieldTeam        = "team"
+	fieldDescription = "description"
+	fieldServers     = "servers"
+	fieldAddress     = "address"
+)
+
+// Redaction modes
+const (
+	modeKeep  = "keep"
+	modeDrop  = "drop"
+	modeHash  = "hash"
+	modeAlias = "alias"
+)
+
+// privacy redacts exported data, nil when disabled
+var privacy *Privacy
+
+// PrivacyConfig controls how identifying fields are exported
+type PrivacyConfig struct {
+	// Fields maps user, team, description, servers and address to keep, drop, hash or alias
+	Fields map[string]string `yaml:"fields"`
+	// Salt of hashed values, so hashes cannot be reversed by hashing known names
+	Salt string `yaml:"salt"`
+	// Aliases replace values of fields in alias mode by field, values without an alias are hashed
+	Aliases map[string]map[string]string `yaml:"aliases"`
+}
+
+// Privacy redacts fields of the collected data and scrubs redacted values from logs and events
+type Privacy struct {
+	cfg PrivacyConfig
+
+	mutex sync.Mutex
+	// Replacement of every redacted value, to scrub them from free text
+	seen     map[string]string
+	replacer *strings.Replacer
+	// Values shorter than minScrubLength, such as team 0, replaced only as whole words
+	short *regexp.Regexp
+}
+
+// minScrubLength is the length below which values are only scrubbed as whole words,
+// replacing them inside other words would garble unrelated text
+const minScrubLength = 4
+
+// NewPrivacy validates the configuration
+func NewPrivacy(cfg PrivacyConfig) (*Privacy, error) {
+	for field, mode := range cfg.Fields {
+		switch field {
+		case fieldUser, fieldTeam, fieldDescription, fieldServers, fieldAddress:
+		default:
+			return nil, fmt.Errorf("unknown privacy field %q", field)
+		}
+		switch mode {
+		case modeKeep, modeDrop, modeHash, modeAlias:
+		default:
+			return nil, fmt.Errorf("unknown privacy mode %q for %s", mode, field)
+		}
+	}
+	for field := range cfg.Aliases {
+		if cfg.Fields[field] != modeAlias {
+			return nil, fmt.Errorf("aliases for %s which is not in alias mode", field)
+		}
+	}
+	p := &Privacy{cfg: cfg, seen: make(map[string]string)}
+	// Aliased values are known, scrub them from the start
+	for field, aliases := range cfg.Aliases {
+		for value := range aliases {
+			p.Register(field, value)
+		}
+	}
+	return p, nil
+}
+
+// Register makes Scrub replace a value before it is exported, for values known from the
+// configuration or read before the data is redacted
+func (p *Privacy) Register(field string, value string) {
+	p.Apply(field, value)
+}
+
+// Secret makes Scrub hide a value which is never exported, such as the passkey
+func (p *Privacy) Secret(value string) {
+	if p == nil || value == "" {
+		return
+	}
+	p.remember(value, "")
+}
+
+// Apply redacts the value of a field
+func (p *Privacy) Apply(field string, value string) string {
+	if p == nil || value == "" {
+		return value
+	}
+	var out string
+	switch p.cfg.Fields[field] {
+	case modeDrop:
+		out = ""
+	case modeHash:
+		out = p.hash(value)
+	case modeAlias:
+		var ok bool
+		if out, ok = p.cfg.Aliases[field][value]; !ok {
+			out = p.hash(value)
+		}
+	default:
+		return value
+	}
+	p.remember(value, out)
+	return out
+}
+
+// Redacts returns whether a field is redacted
+func (p *Privacy) Redacts(field string) bool {
+	if p == nil {
+		return false
+	}
+	mode := p.cfg.Fields[field]
+	return mode != "" && mode != modeKeep
+}
+
+func (p *Privacy) hash(value string) string {
+	mac := hmac.New(sha256.New, []byte(p.cfg.Salt))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))[:12]
+}
+
+// hashID hashes a numeric ID into another, which is stable for the same salt
+func (p *Privacy) hashID(value string) int {
+	id, _ := strconv.ParseInt(p.hash(value)[:7], 16, 64)
+	return int(id)
+}
+
+// remember records a redacted value for Scrub, dropped values are replaced with REDACTED
+func (p *Privacy) remember(value string, out string) {
+	if out == "" {
+		out = "REDACTED"
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.seen[value] == out {
+		return
+	}
+	p.seen[value] = out
+	values := make([]string, 0, len(p.seen))
+	for v := range p.seen {
+		values = append(values, v)
+	}
+	// Longer values first so a value containing another is replaced whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	var pairs, short []string
+	for _, v := range values {
+		if len(v) >= minScrubLength {
+			pairs = append(pairs, v, p.seen[v])
+			continue
+		}
+		pattern := regexp.QuoteMeta(v)
+		if isWordByte(v[0]) {
+			pattern = `\b` + pattern
+		}
+		if isWordByte(v[len(v)-1]) {
+			pattern += `\b`
+		}
+		short = append(short, pattern)
+	}
+	p.replacer = strings.NewReplacer(pairs...)
+	p.short = nil
+	if len(short) > 0 {
+		p.short = regexp.MustCompile(strings.Join(short, "|"))
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// Scrub replaces the values redacted so far in free text, such as error messages
+func (p *Privacy) Scrub(s string) string {
+	if p == nil {
+		return s
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.replacer != nil {
+		s = p.replacer.Replace(s)
+	}
+	if p.short != nil {
+		s = p.short.ReplaceAllStringFunc(s, func(v string) string { return p.seen[v] })
+	}
+	return s
+}
+
+// Metrics returns a redacted copy of the collected data
+func (p *Privacy) Metrics(data Metrics) Metrics {
+	if p == nil {
+		return data
+	}
+	out := data
+	out.Options.User = p.Apply(fieldUser, data.Options.User)
+	out.Options.Team = p.Apply(fieldTeam, data.Options.Team)
+	out.Slots = make([]SlotInfo, len(data.Slots))
+	for i, s := range data.Slots {
+		s.Description = p.Apply(fieldDescription, s.Description)
+		out.Slots[i] = s
+	}
+	out.Queues = make([]QueueInfo, len(data.Queues))
+	for i, q := range data.Queues {
+		q.Ws = p.Apply(fieldServers, q.Ws)
+		q.Cs = p.Apply(fieldServers, q.Cs)
+		out.Queues[i] = q
+	}
+	out.Donor.Name = p.Apply(fieldUser, data.Donor.Name)
+	// The donor ID identifies the user on the stats website
+	if p.Redacts(fieldUser) {
+		out.Donor.ID = 0
+	}
+	out.Donor.Teams = make([]TeamAPI, len(data.Donor.Teams))
+	for i, t := range data.Donor.Teams {
+		if p.Redacts(fieldTeam) {
+			t.Name = p.Apply(fieldTeam, t.Name)
+			// Teams keep distinct IDs, they are a label of the team credit series
+			t.Team = p.hashID(strconv.Itoa(t.Team))
+		}
+		out.Donor.Teams[i] = t
+	}
+	return out
+}
+
+// Levels implements logrus.Hook
+func (p *Privacy) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements logrus.Hook, scrubbing redacted values from log messages
+func (p *Privacy) Fire(entry *log.Entry) error {
+	entry.Message = p.Scrub(entry.Message)
+	for k, v := range entry.Data {
+		switch v := v.(type) {
+		case string:
+			entry.Data[k] = p.Scrub(v)
+		case error:
+			entry.Data[k] = p.Scrub(v.Error())
+		}
+	}
+	return nil
+}
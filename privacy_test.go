@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestScrub(t *testing.T) {
+	p, err := NewPrivacy(PrivacyConfig{
+		Fields:  map[string]string{fieldUser: modeAlias, fieldTeam: modeDrop},
+		Salt:    "salt",
+		Aliases: map[string]map[string]string{fieldUser: {"alice": "folder-1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Aliased values are scrubbed before they are collected
+	if got := p.Scrub("cannot get donor alice"); got != "cannot get donor folder-1" {
+		t.Errorf("aliased user: got %q", got)
+	}
+	p.Register(fieldTeam, "42")
+	p.Secret("0123456789abcdef")
+	for _, tc := range []struct {
+		in   string
+		want string
+	}{
+		{"team 42 has passkey 0123456789abcdef", "team REDACTED has passkey REDACTED"},
+		// Short values are only replaced as whole words
+		{"slot 01 made 4200 PPD for team 42.", "slot 01 made 4200 PPD for team REDACTED."},
+		{"team=42", "team=REDACTED"},
+	} {
+		if got := p.Scrub(tc.in); got != tc.want {
+			t.Errorf("Scrub(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	// Kept fields are not scrubbed
+	p.Register(fieldDescription, "cpu:4")
+	if got := p.Scrub("slot cpu:4"); got != "slot cpu:4" {
+		t.Errorf("kept description was scrubbed: %q", got)
+	}
+}
+
+func TestDefaultClientNameWithoutPrivacy(t *testing.T) {
+	if privacy != nil {
+		t.Fatal("privacy is configured")
+	}
+	if name := defaultClientName("10.0.0.2:36330"); name != "10.0.0.2:36330" {
+		t.Errorf("got %q", name)
+	}
+	if name := defaultClientName(""); name != "" {
+		t.Errorf("got %q for an empty address", name)
+	}
+}
+
+func TestPrivacyDroppedTeams(t *testing.T) {
+	p, err := NewPrivacy(PrivacyConfig{Fields: map[string]string{fieldTeam: modeDrop}, Salt: "salt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := Metrics{Donor: DonorAPI{Teams: []TeamAPI{
+		{Team: 0, Name: "Default (No team specified)", Credit: 100},
+		{Team: 1234, Name: "My team", Credit: 200},
+	}}}
+	teams := p.Metrics(data).Donor.Teams
+	if len(teams) != 2 {
+		t.Fatalf("got teams %+v", teams)
+	}
+	for _, team := range teams {
+		if team.Name != "" {
+			t.Errorf("team name %q was not dropped", team.Name)
+		}
+		if team.Team == 0 || team.Team == 1234 {
+			t.Errorf("team ID %d was not replaced", team.Team)
+		}
+	}
+	// The team credit series are labelled by team and must not collide
+	if teams[0].Team == teams[1].Team {
+		t.Errorf("both teams have ID %d", teams[0].Team)
+	}
+	if again := p.Metrics(data).Donor.Teams; !reflect.DeepEqual(again, teams) {
+		t.Errorf("team IDs changed between collections: %+v and %+v", teams, again)
+	}
+}
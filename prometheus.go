@@ -1,24 +1,37 @@
 package main
 
 import (
-	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	log "github.com/sirupsen/logrus"
 )
 
 const namespace = "fah"
 
+// Metric schema versions, v2 never uses volatile values as labels
+const (
+	schemaV1 = "v1"
+	schemaV2 = "v2"
+)
+
 var (
-	prevMetrics Metrics
-	lastUpdate  time.Time
+	// Known slot states, every slot exports one series per state
+	slotStates = []string{"READY", "RUNNING", "FINISHING", "PAUSED", "STOPPING", "FAILED", "UPDATING", "DISABLED"}
+	// Known queue states, every queue exports one series per state
+	queueStates = []string{"READY", "RUNNING", "DOWNLOAD", "SEND", "PAUSED", "FINISHED", "DELETE", "FAILED"}
 )
 
 // Exporter is the struct for all metrics
 type Exporter struct {
+	client *Client
+	mutex  sync.Mutex
+	// Previously exported data, used to delete stale series
+	prev Metrics
 	// Generic info
 	up        prometheus.Gauge
 	slotCount prometheus.Gauge
@@ -27,201 +40,207 @@ type Exporter struct {
 	description *prometheus.GaugeVec
 	idle        *prometheus.GaugeVec
 	paused      *prometheus.GaugeVec
+	slotStatus  *prometheus.GaugeVec
+	// Slot options
+	slotOptionsInfo        *prometheus.GaugeVec
+	slotCPUs               *prometheus.GaugeVec
+	slotNextUnitPercentage *prometheus.GaugeVec
+	slotMaxUnits           *prometheus.GaugeVec
+	slotCheckpoint         *prometheus.GaugeVec
 	// Queue info
 	framesDone  *prometheus.GaugeVec
 	totalFrames *prometheus.GaugeVec
 	percentDone *prometheus.GaugeVec
 	ppd         *prometheus.GaugeVec
 	queueInfo   *prometheus.GaugeVec
+	queueState  *prometheus.GaugeVec
+	// Queue values (schema v2)
+	queueError  *prometheus.GaugeVec
+	queueValues []queueValue
+	// Deadline risk
+	projectedCompletion *prometheus.GaugeVec
+	deadlineMargin      *prometheus.GaugeVec
+	atRisk              *prometheus.GaugeVec
 	// Donor API
 	donorCredit     *prometheus.GaugeVec
 	donorID         *prometheus.GaugeVec
 	donorRank       *prometheus.GaugeVec
 	donorTeamCredit *prometheus.GaugeVec
+	// Configuration audit
+	configDrift *prometheus.GaugeVec
+	// Power sources
+	power      *prometheus.GaugeVec
+	ppdPerWatt *prometheus.GaugeVec
+	// Energy accounting, exported holds the totals already added to the counters
+	energyJoules      *prometheus.CounterVec
+	energyCost        *prometheus.CounterVec
+	co2Grams          *prometheus.CounterVec
+	creditPerCurrency *prometheus.GaugeVec
+	energyExported    map[string]energyTotals
+}
+
+// queueValue is a numeric queue value exported as its own gauge
+type queueValue struct {
+	vec   *prometheus.GaugeVec
+	value func(q QueueInfo) (float64, error)
+}
+
+func newQueueValue(spec metricSpec, value func(q QueueInfo) (float64, error)) queueValue {
+	return queueValue{vec: spec.gaugeVec(), value: value}
+}
+
+func durationSeconds(s string) (float64, error) {
+	d, err := parseFAHDuration(s)
+	return d.Seconds(), err
+}
+
+func timestampSeconds(s string) (float64, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	return float64(t.Unix()), err
 }
 
 // Metrics collected metrics
 type Metrics struct {
-	Slots   []SlotInfo
-	Queues  []QueueInfo
-	Options Options
-	Donor   DonorAPI
+	Slots       []SlotInfo
+	SlotOptions map[string]SlotOptions
+	Queues      []QueueInfo
+	Options     Options
+	Donor       DonorAPI
 }
 
-// NewExporter initializes the Exporter struct
-func NewExporter() *Exporter {
-	return &Exporter{
+// NewExporter initializes the Exporter struct for a FAH client
+func NewExporter(client *Client) *Exporter {
+	specs := make(map[string]metricSpec)
+	for _, m := range exporterMetrics() {
+		specs[m.name] = m
+	}
+	e := &Exporter{
+		client: client,
 		// Generic info
-		up: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "up",
-				Help:      "FAH Metric Collection Operational",
-			},
-		),
-		slotCount: prometheus.NewGauge(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "slot_count",
-				Help:      "Count of folding slots",
-			},
-		),
-		options: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "options",
-				Help:      "Client options",
-			},
-			[]string{"user", "team", "power"},
-		),
+		up:        specs["up"].gauge(),
+		slotCount: specs["slot_count"].gauge(),
+		options:   specs["options"].gaugeVec(),
 		// Slot info
-		description: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "description",
-				Help:      "Folding slot description",
-			},
-			[]string{"slot", "description"},
-		),
-		idle: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "idle",
-				Help:      "Whether slot is idle",
-			},
-			[]string{"slot"},
-		),
-		paused: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "paused",
-				Help:      "Whether slot is paused",
-			},
-			[]string{"slot", "reason"},
-		),
+		description: specs["description"].gaugeVec(),
+		idle:        specs["idle"].gaugeVec(),
+		paused:      specs["paused"].gaugeVec(),
+		slotStatus:  specs["slot_status"].gaugeVec(),
+		// Slot options
+		slotOptionsInfo:        specs["slot_options_info"].gaugeVec(),
+		slotCPUs:               specs["slot_cpus"].gaugeVec(),
+		slotNextUnitPercentage: specs["slot_next_unit_percentage"].gaugeVec(),
+		slotMaxUnits:           specs["slot_max_units"].gaugeVec(),
+		slotCheckpoint:         specs["slot_checkpoint_minutes"].gaugeVec(),
 		// Queue info
-		framesDone: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "frames_done",
-				Help:      "Task frames done",
-			},
-			[]string{"slot", "queue"},
-		),
-		totalFrames: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "total_frames",
-				Help:      "Task total frames",
-			},
-			[]string{"slot", "queue"},
-		),
-		percentDone: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "percent_done",
-				Help:      "Task percent done",
-			},
-			[]string{"slot", "queue"},
-		),
-		ppd: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "ppd",
-				Help:      "Task points per day",
-			},
-			[]string{"slot", "queue"},
-		),
-		queueInfo: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "queue_info",
-				Help:      "Task state, ETA and eventual error",
-			},
-			[]string{"slot", "queue", "state", "eta", "error"},
-		),
+		framesDone:  specs["frames_done"].gaugeVec(),
+		totalFrames: specs["total_frames"].gaugeVec(),
+		percentDone: specs["percent_done"].gaugeVec(),
+		ppd:         specs["ppd"].gaugeVec(),
+		queueInfo:   specs["queue_info"].gaugeVec(),
+		queueState:  specs["queue_state"].gaugeVec(),
+		// Queue values (schema v2)
+		queueError: specs["queue_error"].gaugeVec(),
+		// Deadline risk
+		projectedCompletion: specs["unit_projected_completion_timestamp_seconds"].gaugeVec(),
+		deadlineMargin:      specs["unit_deadline_margin_seconds"].gaugeVec(),
+		atRisk:              specs["unit_at_risk"].gaugeVec(),
 		// Donor API
-		donorCredit: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "donor_credit",
-				Help:      "Donor total credit",
-			},
-			[]string{"user"},
-		),
-		donorID: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "donor_id",
-				Help:      "Donor user ID",
-			},
-			[]string{"user"},
-		),
-		donorRank: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "donor_rank",
-				Help:      "Donor rank",
-			},
-			[]string{"user"},
-		),
-		donorTeamCredit: prometheus.NewGaugeVec(
-			prometheus.GaugeOpts{
-				Namespace: namespace,
-				Name:      "donor_team_credit",
-				Help:      "Donor credit per team",
-			},
-			[]string{"user", "name", "team"},
-		),
+		donorCredit:     specs["donor_credit"].gaugeVec(),
+		donorID:         specs["donor_id"].gaugeVec(),
+		donorRank:       specs["donor_rank"].gaugeVec(),
+		donorTeamCredit: specs["donor_team_credit"].gaugeVec(),
+		// Configuration audit
+		configDrift: specs["config_drift"].gaugeVec(),
+		// Power sources
+		power:      specs["power_watts"].gaugeVec(),
+		ppdPerWatt: specs["ppd_per_watt"].gaugeVec(),
+		// Energy accounting
+		energyJoules:      specs["energy_joules_total"].counterVec(),
+		energyCost:        specs["energy_cost_total"].counterVec(),
+		co2Grams:          specs["co2_grams_total"].counterVec(),
+		creditPerCurrency: specs["credit_per_currency"].gaugeVec(),
+		energyExported:    make(map[string]energyTotals),
+	}
+	e.queueValues = []queueValue{
+		newQueueValue(specs["queue_eta_seconds"], func(q QueueInfo) (float64, error) {
+			return durationSeconds(q.Eta)
+		}),
+		newQueueValue(specs["queue_time_remaining_seconds"], func(q QueueInfo) (float64, error) {
+			return durationSeconds(q.TimeRemaining)
+		}),
+		newQueueValue(specs["queue_tpf_seconds"], func(q QueueInfo) (float64, error) {
+			return durationSeconds(q.Tpf)
+		}),
+		newQueueValue(specs["queue_next_attempt_seconds"], func(q QueueInfo) (float64, error) {
+			return durationSeconds(q.NextAttempt)
+		}),
+		newQueueValue(specs["queue_attempts"], func(q QueueInfo) (float64, error) {
+			return float64(q.Attempts), nil
+		}),
+		newQueueValue(specs["queue_credit_estimate"], func(q QueueInfo) (float64, error) {
+			return strconv.ParseFloat(q.CreditEstimate, 64)
+		}),
+		newQueueValue(specs["queue_base_credit"], func(q QueueInfo) (float64, error) {
+			return strconv.ParseFloat(q.BaseCredit, 64)
+		}),
+		newQueueValue(specs["queue_assigned_timestamp_seconds"], func(q QueueInfo) (float64, error) {
+			return timestampSeconds(q.Assigned)
+		}),
+		newQueueValue(specs["queue_timeout_timestamp_seconds"], func(q QueueInfo) (float64, error) {
+			return timestampSeconds(q.Timeout)
+		}),
+		newQueueValue(specs["queue_deadline_timestamp_seconds"], func(q QueueInfo) (float64, error) {
+			return timestampSeconds(q.Deadline)
+		}),
 	}
+	return e
 }
 
-func collectMetrics() (data Metrics, err error) {
-	conn, err := net.Dial("tcp", fahAddress)
-	if err != nil {
-		log.Errorf("Cannot connect to FAH client: %v", err)
-		return
-	}
-	defer conn.Close()
-	err = ReadFAH(conn, "queue-info", &data.Queues)
-	if err != nil {
-		log.Errorf("Cannot read queue info: %v", err)
-		return
-	}
-	err = ReadFAH(conn, "slot-info", &data.Slots)
+// slotOptionsLabelValues returns the fah_slot_options_info label values
+func slotOptionsLabelValues(id string, o SlotOptions) []string {
+	return []string{id, o.Cause, o.ClientType, o.ClientSubtype, o.CorePriority, o.GPUIndex, o.MaxPacketSize}
+}
+
+// setSlotOption sets a numeric slot option, values which cannot be parsed are skipped
+func setSlotOption(vec *prometheus.GaugeVec, id string, value string) {
+	v, err := strconv.ParseFloat(value, 64)
 	if err != nil {
-		log.Errorf("Cannot read slot info: %v", err)
+		log.Debugf("Cannot parse slot %s option %q: %v", id, value, err)
 		return
 	}
-	err = ReadFAH(conn, "options", &data.Options)
-	if err != nil {
-		log.Errorf("Cannot read options: %v", err)
-		return
+	vec.WithLabelValues(id).Set(v)
+}
+
+// pausedLabelValues returns the fah_paused label values for the metric schema in use
+func pausedLabelValues(s SlotInfo) []string {
+	if metricsSchema == schemaV2 {
+		return []string{s.ID}
 	}
-	if getAPI {
-		if time.Since(lastUpdate).Seconds() > apiThrottle.Seconds() {
-			log.Debugf("Getting donor API data")
-			err = ReadAPI("/donor/"+data.Options.User, &data.Donor)
-			if err != nil {
-				log.Errorf("Cannot get donor info from API: %v", err)
-			}
-			lastUpdate = time.Now()
-		} else {
-			data.Donor = prevMetrics.Donor
-		}
+	return []string{s.ID, s.Reason}
+}
+
+// queueInfoLabelValues returns the fah_queue_info label values for the metric schema in use
+func queueInfoLabelValues(q QueueInfo) []string {
+	if metricsSchema == schemaV2 {
+		return []string{q.Slot, q.ID, strconv.Itoa(q.Project), strconv.Itoa(q.Run),
+			strconv.Itoa(q.Clone), strconv.Itoa(q.Gen), q.Core, q.Unit}
 	}
-	return
+	return []string{q.Slot, q.ID, q.State, q.Eta, q.Error}
 }
 
 // Collect is called by the Prometheus registry when collecting metrics
 func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
-	data, err := collectMetrics()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	raw, err := e.client.Collect()
 	if err != nil {
 		log.Errorf("Failed to collect metrics: %s", err)
 		e.up.Set(0)
 		e.up.Collect(metrics)
 		return
 	}
+	// The config audit needs the raw data, everything else is exported redacted
+	data := privacy.Metrics(raw)
 
 	e.up.Set(1)
 	e.slotCount.Set(float64(len(data.Slots)))
@@ -229,20 +248,38 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 	// Delete previous data
 	// This is done so that we don't keep showing old data
 	// when a slot is removed for example
-	e.options.DeleteLabelValues(prevMetrics.Options.User, prevMetrics.Options.Team, data.Options.Power)
-	for _, s := range prevMetrics.Slots {
+	e.options.DeleteLabelValues(e.prev.Options.User, e.prev.Options.Team, data.Options.Power)
+	for _, s := range e.prev.Slots {
 		e.description.DeleteLabelValues(s.ID, s.Description)
 		e.idle.DeleteLabelValues(s.ID)
-		e.paused.DeleteLabelValues(s.ID, s.Reason)
+		e.paused.DeleteLabelValues(pausedLabelValues(s)...)
+	}
+	for id, o := range e.prev.SlotOptions {
+		e.slotOptionsInfo.DeleteLabelValues(slotOptionsLabelValues(id, o)...)
+		e.slotCPUs.DeleteLabelValues(id)
+		e.slotNextUnitPercentage.DeleteLabelValues(id)
+		e.slotMaxUnits.DeleteLabelValues(id)
+		e.slotCheckpoint.DeleteLabelValues(id)
 	}
-	for _, q := range prevMetrics.Queues {
+	for _, q := range e.prev.Queues {
 		e.framesDone.DeleteLabelValues(q.Slot, q.ID)
 		e.totalFrames.DeleteLabelValues(q.Slot, q.ID)
 		e.percentDone.DeleteLabelValues(q.Slot, q.ID)
 		e.ppd.DeleteLabelValues(q.Slot, q.ID)
-		e.queueInfo.DeleteLabelValues(q.Slot, q.ID, q.State, q.Eta, q.Error)
+		e.queueInfo.DeleteLabelValues(queueInfoLabelValues(q)...)
+		e.queueError.DeleteLabelValues(q.Slot, q.ID, q.Error)
+		for _, v := range e.queueValues {
+			v.vec.DeleteLabelValues(q.Slot, q.ID)
+		}
+		e.projectedCompletion.DeleteLabelValues(q.Slot, q.ID)
+		e.deadlineMargin.DeleteLabelValues(q.Slot, q.ID)
+		e.atRisk.DeleteLabelValues(q.Slot, q.ID)
 	}
 
+	// State sets always contain every known state, no need to track previous values
+	e.slotStatus.Reset()
+	e.queueState.Reset()
+
 	e.options.WithLabelValues(data.Options.User, data.Options.Team, data.Options.Power).Set(1)
 
 	// Add collected slot data
@@ -254,13 +291,24 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 			e.idle.WithLabelValues(s.ID).Set(0)
 		}
 		if s.Options.Paused {
-			e.paused.WithLabelValues(s.ID, s.Reason).Set(1)
+			e.paused.WithLabelValues(pausedLabelValues(s)...).Set(1)
 		} else {
-			e.paused.WithLabelValues(s.ID, s.Reason).Set(0)
+			e.paused.WithLabelValues(pausedLabelValues(s)...).Set(0)
 		}
+		setStates(e.slotStatus, slotStates, s.Status, s.ID)
+	}
+
+	// Add collected slot options
+	for id, o := range data.SlotOptions {
+		e.slotOptionsInfo.WithLabelValues(slotOptionsLabelValues(id, o)...).Set(1)
+		setSlotOption(e.slotCPUs, id, o.CPUs)
+		setSlotOption(e.slotNextUnitPercentage, id, o.NextUnitPercentage)
+		setSlotOption(e.slotMaxUnits, id, o.MaxUnits)
+		setSlotOption(e.slotCheckpoint, id, o.Checkpoint)
 	}
 
 	// Add collected queue data
+	now := time.Now()
 	for _, q := range data.Queues {
 		e.framesDone.WithLabelValues(q.Slot, q.ID).Set(float64(q.FramesDone))
 		e.totalFrames.WithLabelValues(q.Slot, q.ID).Set(float64(q.TotalFrames))
@@ -276,7 +324,30 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 			return
 		}
 		e.ppd.WithLabelValues(q.Slot, q.ID).Set(ppd)
-		e.queueInfo.WithLabelValues(q.Slot, q.ID, q.State, q.Eta, q.Error).Set(1)
+		e.queueInfo.WithLabelValues(queueInfoLabelValues(q)...).Set(1)
+		if metricsSchema == schemaV2 {
+			e.queueError.WithLabelValues(q.Slot, q.ID, q.Error).Set(1)
+			for _, v := range e.queueValues {
+				if value, err := v.value(q); err == nil {
+					v.vec.WithLabelValues(q.Slot, q.ID).Set(value)
+				}
+			}
+		}
+		setStates(e.queueState, queueStates, q.State, q.Slot, q.ID)
+		// Timeout and ETA are not always known, for example while downloading
+		if completion, err := q.ProjectedCompletion(now); err == nil {
+			e.projectedCompletion.WithLabelValues(q.Slot, q.ID).Set(float64(completion.Unix()))
+		}
+		if margin, err := q.DeadlineMargin(now); err == nil {
+			e.deadlineMargin.WithLabelValues(q.Slot, q.ID).Set(margin.Seconds())
+			if margin < 0 {
+				e.atRisk.WithLabelValues(q.Slot, q.ID).Set(1)
+			} else {
+				e.atRisk.WithLabelValues(q.Slot, q.ID).Set(0)
+			}
+		} else {
+			log.Debugf("Cannot compute deadline margin for queue %s: %v", q.ID, err)
+		}
 	}
 
 	e.up.Collect(metrics)
@@ -285,21 +356,40 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 	e.description.Collect(metrics)
 	e.idle.Collect(metrics)
 	e.paused.Collect(metrics)
+	e.slotStatus.Collect(metrics)
+	e.slotOptionsInfo.Collect(metrics)
+	e.slotCPUs.Collect(metrics)
+	e.slotNextUnitPercentage.Collect(metrics)
+	e.slotMaxUnits.Collect(metrics)
+	e.slotCheckpoint.Collect(metrics)
 	e.framesDone.Collect(metrics)
 	e.totalFrames.Collect(metrics)
 	e.percentDone.Collect(metrics)
 	e.ppd.Collect(metrics)
 	e.queueInfo.Collect(metrics)
+	e.queueState.Collect(metrics)
+	if metricsSchema == schemaV2 {
+		e.queueError.Collect(metrics)
+		for _, v := range e.queueValues {
+			v.vec.Collect(metrics)
+		}
+	}
+	e.projectedCompletion.Collect(metrics)
+	e.deadlineMargin.Collect(metrics)
+	e.atRisk.Collect(metrics)
 
 	if getAPI {
 		e.donorCredit.DeleteLabelValues(data.Donor.Name)
 		e.donorID.DeleteLabelValues(data.Donor.Name)
 		e.donorRank.DeleteLabelValues(data.Donor.Name)
-		for _, t := range prevMetrics.Donor.Teams {
-			e.donorTeamCredit.DeleteLabelValues(prevMetrics.Donor.Name, t.Name, strconv.Itoa(t.Team))
+		for _, t := range e.prev.Donor.Teams {
+			e.donorTeamCredit.DeleteLabelValues(e.prev.Donor.Name, t.Name, strconv.Itoa(t.Team))
 		}
 		e.donorCredit.WithLabelValues(data.Donor.Name).Set(float64(data.Donor.Credit))
-		e.donorID.WithLabelValues(data.Donor.Name).Set(float64(data.Donor.ID))
+		// Zero when the user is redacted
+		if data.Donor.ID != 0 {
+			e.donorID.WithLabelValues(data.Donor.Name).Set(float64(data.Donor.ID))
+		}
 		e.donorRank.WithLabelValues(data.Donor.Name).Set(float64(data.Donor.Rank))
 		for _, t := range data.Donor.Teams {
 			e.donorTeamCredit.WithLabelValues(data.Donor.Name, t.Name, strconv.Itoa(t.Team)).Set(float64(t.Credit))
@@ -310,7 +400,41 @@ func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
 		e.donorTeamCredit.Collect(metrics)
 	}
 
-	prevMetrics = data
+	if config.Desired != nil {
+		e.configDrift.Reset()
+		drifts := auditConfig(config.Desired, raw)
+		for _, d := range drifts {
+			if d.Drift {
+				e.configDrift.WithLabelValues(d.Setting, d.Slot).Set(1)
+			} else {
+				e.configDrift.WithLabelValues(d.Setting, d.Slot).Set(0)
+			}
+		}
+		e.configDrift.Collect(metrics)
+	}
+
+	if e.client.power != nil {
+		e.collectPower(raw, metrics)
+	}
+
+	e.prev = data
+}
+
+// setStates exports a state set, the current state is 1 and all other known states are 0.
+// Unknown states are added so they are not lost.
+func setStates(vec *prometheus.GaugeVec, known []string, current string, labels ...string) {
+	found := false
+	for _, state := range known {
+		value := 0.0
+		if state == current {
+			value = 1
+			found = true
+		}
+		vec.WithLabelValues(append(labels, state)...).Set(value)
+	}
+	if !found && current != "" {
+		vec.WithLabelValues(append(labels, current)...).Set(1)
+	}
 }
 
 // Describe sends the super-set of all possible descriptors
@@ -321,11 +445,27 @@ func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
 	e.description.Describe(descs)
 	e.idle.Describe(descs)
 	e.paused.Describe(descs)
+	e.slotStatus.Describe(descs)
+	e.slotOptionsInfo.Describe(descs)
+	e.slotCPUs.Describe(descs)
+	e.slotNextUnitPercentage.Describe(descs)
+	e.slotMaxUnits.Describe(descs)
+	e.slotCheckpoint.Describe(descs)
 	e.framesDone.Describe(descs)
 	e.totalFrames.Describe(descs)
 	e.percentDone.Describe(descs)
 	e.ppd.Describe(descs)
 	e.queueInfo.Describe(descs)
+	e.queueState.Describe(descs)
+	if metricsSchema == schemaV2 {
+		e.queueError.Describe(descs)
+		for _, v := range e.queueValues {
+			v.vec.Describe(descs)
+		}
+	}
+	e.projectedCompletion.Describe(descs)
+	e.deadlineMargin.Describe(descs)
+	e.atRisk.Describe(descs)
 
 	if getAPI {
 		e.donorCredit.Describe(descs)
@@ -333,4 +473,142 @@ func (e *Exporter) Describe(descs chan<- *prometheus.Desc) {
 		e.donorRank.Describe(descs)
 		e.donorTeamCredit.Describe(descs)
 	}
+
+	if config.Desired != nil {
+		e.configDrift.Describe(descs)
+	}
+
+	if e.client != nil && e.client.power != nil {
+		e.power.Describe(descs)
+		e.ppdPerWatt.Describe(descs)
+		if energy != nil {
+			e.energyJoules.Describe(descs)
+			if energy.Currency() != "" {
+				e.energyCost.Describe(descs)
+				e.creditPerCurrency.Describe(descs)
+			}
+			if energy.Carbon() {
+				e.co2Grams.Describe(descs)
+			}
+		}
+	}
+}
+
+// collectPower exports the power sources and the efficiency of the slots and host with a known power
+func (e *Exporter) collectPower(data Metrics, metrics chan<- prometheus.Metric) {
+	readings, err := e.client.power.Read(data.Slots)
+	if err != nil {
+		log.Errorf("Cannot read power of %s: %v", e.client.Name, err)
+	}
+	// Slots come and go and sources may fail, rebuild everything on every scrape
+	e.power.Reset()
+	e.ppdPerWatt.Reset()
+	watts := make(map[string]float64)
+	for _, r := range readings {
+		e.power.WithLabelValues(r.Slot, r.Source).Add(r.Watts)
+		watts[r.Slot] += r.Watts
+	}
+	ppd := slotPPD(data.Queues)
+	for slot, w := range watts {
+		if w > 0 {
+			e.ppdPerWatt.WithLabelValues(slot).Set(ppd[slot] / w)
+		}
+	}
+	e.power.Collect(metrics)
+	e.ppdPerWatt.Collect(metrics)
+	if energy != nil {
+		e.collectEnergy(watts, ppd, metrics)
+	}
+}
+
+// collectEnergy accumulates the power of the slots and exports the totals, restored totals
+// are added the first time a slot is exported
+func (e *Exporter) collectEnergy(watts map[string]float64, ppd map[string]float64, metrics chan<- prometheus.Metric) {
+	now := time.Now()
+	currency := energy.Currency()
+	for slot, t := range energy.Record(e.client.Name, watts, now) {
+		prev := e.energyExported[slot]
+		e.energyJoules.WithLabelValues(slot).Add(t.Joules - prev.Joules)
+		if currency != "" {
+			e.energyCost.WithLabelValues(slot, currency).Add(t.Cost - prev.Cost)
+		}
+		if energy.Carbon() {
+			e.co2Grams.WithLabelValues(slot).Add(t.CO2 - prev.CO2)
+		}
+		e.energyExported[slot] = t
+	}
+	e.creditPerCurrency.Reset()
+	if currency != "" {
+		price := energy.Price(now)
+		for slot, w := range watts {
+			if v, ok := creditPerCurrency(ppd[slot], w, price); ok {
+				e.creditPerCurrency.WithLabelValues(slot, currency).Set(v)
+			}
+		}
+	}
+	e.energyJoules.Collect(metrics)
+	if currency != "" {
+		e.energyCost.Collect(metrics)
+		e.creditPerCurrency.Collect(metrics)
+	}
+	if energy.Carbon() {
+		e.co2Grams.Collect(metrics)
+	}
+}
+
+// gatherFAH gathers the fah metric families for the push outputs, gather errors are logged
+// rather than returned since failed clients are still reported by fah_up
+func gatherFAH(gatherer prometheus.Gatherer, output string) []*dto.MetricFamily {
+	families, err := gatherer.Gather()
+	if err != nil {
+		log.Warnf("Gathering metrics for %s: %v", output, err)
+	}
+	// The families may be shared with other outputs, filter into a new slice
+	var out []*dto.MetricFamily
+	for _, mf := range families {
+		if strings.HasPrefix(mf.GetName(), namespace+"_") {
+			out = append(out, mf)
+		}
+	}
+	return out
+}
+
+// sharedGatherer gathers once for all push outputs, a gather newer than maxAge is reused
+// so outputs pushing on the same interval do not each collect every client again
+type sharedGatherer struct {
+	gatherer prometheus.Gatherer
+	maxAge   time.Duration
+
+	mutex    sync.Mutex
+	families []*dto.MetricFamily
+	err      error
+	time     time.Time
+}
+
+func newSharedGatherer(gatherer prometheus.Gatherer) *sharedGatherer {
+	return &sharedGatherer{gatherer: gatherer}
+}
+
+// Gather implements prometheus.Gatherer, the returned families must not be modified
+func (g *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.time.IsZero() || time.Since(g.time) >= g.maxAge {
+		g.families, g.err = g.gatherer.Gather()
+		g.time = time.Now()
+	}
+	return g.families, g.err
+}
+
+// sampleValue returns the value of a gauge, counter or untyped sample
+func sampleValue(m *dto.Metric) (float64, bool) {
+	switch {
+	case m.GetGauge() != nil:
+		return m.GetGauge().GetValue(), true
+	case m.GetCounter() != nil:
+		return m.GetCounter().GetValue(), true
+	case m.GetUntyped() != nil:
+		return m.GetUntyped().GetValue(), true
+	}
+	return 0, false
 }
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// HTTPAuth authenticates push requests with basic auth or a bearer token
+type HTTPAuth struct {
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+}
+
+// RetryConfig retries failed pushes, backing off exponentially from RetryBackoff
+type RetryConfig struct {
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+}
+
+// RemoteWriteConfig configures pushing the metrics with the Prometheus remote write protocol
+type RemoteWriteConfig struct {
+	URL         string `yaml:"url"`
+	HTTPAuth    `yaml:",inline"`
+	RetryConfig `yaml:",inline"`
+	Headers     map[string]string `yaml:"headers"`
+	// ExternalLabels are added to every series which does not have them
+	ExternalLabels map[string]string `yaml:"external_labels"`
+	// BufferDir keeps requests which could not be sent until the endpoint is back, disabled when empty
+	BufferDir string `yaml:"buffer_dir"`
+	// BufferMaxBytes bounds the buffer, the oldest requests are dropped first
+	BufferMaxBytes int64         `yaml:"buffer_max_bytes"`
+	Interval       time.Duration `yaml:"interval"`
+}
+
+// PushgatewayConfig configures pushing the metrics of every client to a Pushgateway
+type PushgatewayConfig struct {
+	URL         string `yaml:"url"`
+	Job         string `yaml:"job"`
+	HTTPAuth    `yaml:",inline"`
+	RetryConfig `yaml:",inline"`
+	Interval    time.Duration `yaml:"interval"`
+}
+
+func (r *RetryConfig) setDefaults() {
+	if r.MaxRetries == 0 {
+		r.MaxRetries = 3
+	}
+	if r.RetryBackoff == 0 {
+		r.RetryBackoff = time.Second
+	}
+}
+
+// authDoer sends requests with the configured authentication
+type authDoer struct {
+	auth    HTTPAuth
+	headers map[string]string
+}
+
+func (d authDoer) Do(req *http.Request) (*http.Response, error) {
+	switch {
+	case d.auth.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+d.auth.BearerToken)
+	case d.auth.Username != "":
+		req.SetBasicAuth(d.auth.Username, d.auth.Password)
+	}
+	for k, v := range d.headers {
+		req.Header.Set(k, v)
+	}
+	return myClient.Do(req)
+}
+
+// permanentError is not retried, such as a request rejected by the server
+type permanentError struct {
+	error
+}
+
+// retry calls fn until it succeeds, fails permanently or runs out of retries
+func retry(name string, cfg RetryConfig, fn func() error) error {
+	backoff := cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		var perm permanentError
+		if err == nil || errors.As(err, &perm) || attempt >= cfg.MaxRetries {
+			return err
+		}
+		log.Debugf("%s attempt %d failed, retrying in %s: %v", name, attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// RemoteWriter periodically pushes the metrics with remote write
+type RemoteWriter struct {
+	cfg      RemoteWriteConfig
+	gatherer prometheus.Gatherer
+	client   authDoer
+}
+
+// NewRemoteWriter validates the configuration and applies defaults
+func NewRemoteWriter(cfg RemoteWriteConfig, gatherer prometheus.Gatherer) (*RemoteWriter, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("remote write has no URL")
+	}
+	cfg.setDefaults()
+	if cfg.BufferMaxBytes == 0 {
+		cfg.BufferMaxBytes = 64 << 20
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	if cfg.BufferDir != "" {
+		if err := os.MkdirAll(cfg.BufferDir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	return &RemoteWriter{
+		cfg:      cfg,
+		gatherer: gatherer,
+		client:   authDoer{auth: cfg.HTTPAuth, headers: cfg.Headers},
+	}, nil
+}
+
+// Run pushes the metrics every interval until the process exits
+func (w *RemoteWriter) Run() {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		w.Push()
+		<-ticker.C
+	}
+}
+
+// Push sends the buffered requests, oldest first, followed by the current metrics
+func (w *RemoteWriter) Push() {
+	body := snappy.Encode(nil, encodeWriteRequest(gatherFAH(w.gatherer, "remote write"), time.Now(), w.cfg.ExternalLabels))
+	if err := w.flushBuffer(); err != nil {
+		log.Errorf("Cannot send buffered remote write requests: %v", err)
+		w.buffer(body)
+		return
+	}
+	err := retry("Remote write", w.cfg.RetryConfig, func() error { return w.send(body) })
+	var perm permanentError
+	switch {
+	case errors.As(err, &perm):
+		log.Errorf("Remote write rejected, dropping samples: %v", err)
+	case err != nil:
+		log.Errorf("Cannot send remote write request: %v", err)
+		w.buffer(body)
+	}
+}
+
+func (w *RemoteWriter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "fah-exporter")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 300 {
+		return nil
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	// Client errors other than rate limiting will not succeed when retried
+	if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// bufferFiles returns the buffered requests, oldest first
+func (w *RemoteWriter) bufferFiles() ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(w.cfg.BufferDir, "*.snappy"))
+	sort.Strings(files)
+	return files, err
+}
+
+// buffer stores a request which could not be sent, dropping the oldest requests above the size limit
+func (w *RemoteWriter) buffer(body []byte) {
+	if w.cfg.BufferDir == "" {
+		return
+	}
+	name := filepath.Join(w.cfg.BufferDir, fmt.Sprintf("%020d.snappy", time.Now().UnixNano()))
+	if err := os.WriteFile(name, body, 0o644); err != nil {
+		log.Errorf("Cannot buffer remote write request: %v", err)
+		return
+	}
+	files, err := w.bufferFiles()
+	if err != nil {
+		log.Errorf("Cannot list remote write buffer: %v", err)
+		return
+	}
+	var total int64
+	sizes := make([]int64, len(files))
+	for i, f := range files {
+		if fi, err := os.Stat(f); err == nil {
+			sizes[i] = fi.Size()
+			total += sizes[i]
+		}
+	}
+	for i := 0; i < len(files) && total > w.cfg.BufferMaxBytes; i++ {
+		log.Warnf("Remote write buffer is full, dropping %s", filepath.Base(files[i]))
+		os.Remove(files[i])
+		total -= sizes[i]
+	}
+}
+
+// flushBuffer sends the buffered requests, stopping at the first failure
+func (w *RemoteWriter) flushBuffer() error {
+	if w.cfg.BufferDir == "" {
+		return nil
+	}
+	files, err := w.bufferFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		body, err := os.ReadFile(f)
+		if err != nil {
+			return err
+		}
+		err = retry("Remote write", w.cfg.RetryConfig, func() error { return w.send(body) })
+		var perm permanentError
+		if errors.As(err, &perm) {
+			log.Errorf("Remote write rejected buffered %s, dropping it: %v", filepath.Base(f), err)
+		} else if err != nil {
+			return err
+		}
+		os.Remove(f)
+	}
+	if len(files) > 0 {
+		log.Infof("Sent %d buffered remote write requests", len(files))
+	}
+	return nil
+}
+
+// encodeWriteRequest encodes the samples as a remote write WriteRequest protobuf message
+func encodeWriteRequest(families []*dto.MetricFamily, now time.Time, external map[string]string) []byte {
+	ts := now.UnixMilli()
+	var req []byte
+	for _, mf := range families {
+		for _, m := range mf.GetMetric() {
+			value, ok := sampleValue(m)
+			if !ok {
+				continue
+			}
+			labels := map[string]string{"__name__": mf.GetName()}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			for k, v := range external {
+				if _, ok := labels[k]; !ok {
+					labels[k] = v
+				}
+			}
+			// Labels must be sorted by name
+			names := make([]string, 0, len(labels))
+			for k := range labels {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+
+			var series []byte
+			for _, k := range names {
+				var label []byte
+				label = protowire.AppendTag(label, 1, protowire.BytesType)
+				label = protowire.AppendString(label, k)
+				label = protowire.AppendTag(label, 2, protowire.BytesType)
+				label = protowire.AppendString(label, labels[k])
+				series = protowire.AppendTag(series, 1, protowire.BytesType)
+				series = protowire.AppendBytes(series, label)
+			}
+			var sample []byte
+			sample = protowire.AppendTag(sample, 1, protowire.Fixed64Type)
+			sample = protowire.AppendFixed64(sample, math.Float64bits(value))
+			sample = protowire.AppendTag(sample, 2, protowire.VarintType)
+			sample = protowire.AppendVarint(sample, uint64(ts))
+			series = protowire.AppendTag(series, 2, protowire.BytesType)
+			series = protowire.AppendBytes(series, sample)
+
+			req = protowire.AppendTag(req, 1, protowire.BytesType)
+			req = protowire.AppendBytes(req, series)
+		}
+	}
+	return req
+}
+
+// Pushgateway periodically pushes the metrics of every client to a Pushgateway, grouped by client
+type Pushgateway struct {
+	cfg      PushgatewayConfig
+	gatherer prometheus.Gatherer
+	clients  *ClientSet
+}
+
+// NewPushgateway validates the configuration and applies defaults
+func NewPushgateway(cfg PushgatewayConfig, gatherer prometheus.Gatherer, clients *ClientSet) (*Pushgateway, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("pushgateway has no URL")
+	}
+	if cfg.Job == "" {
+		cfg.Job = "fah"
+	}
+	cfg.setDefaults()
+	if cfg.Interval == 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	return &Pushgateway{cfg: cfg, gatherer: gatherer, clients: clients}, nil
+}
+
+// Run pushes the metrics every interval until the process exits
+func (p *Pushgateway) Run() {
+	ticker := time.NewTicker(p.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		p.Push()
+		<-ticker.C
+	}
+}
+
+// Push gathers the metrics once and replaces the group of every client, failed pushes are
+// retried but not buffered since the Pushgateway only keeps the latest push
+func (p *Pushgateway) Push() {
+	families := gatherFAH(p.gatherer, "Pushgateway")
+	for _, c := range p.clients.All() {
+		p.push(c.Name, clientFamilies(families, c.Name))
+	}
+	// Exporter metrics such as the fleet aggregates are pushed once to the job group
+	if group := clientFamilies(families, ""); len(group) > 0 {
+		p.push("", group)
+	}
+}
+
+// push replaces the group of client, or the job group when client is empty
+func (p *Pushgateway) push(client string, group []*dto.MetricFamily) {
+	pusher := push.New(p.cfg.URL, p.cfg.Job).
+		Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return group, nil })).
+		Client(authDoer{auth: p.cfg.HTTPAuth})
+	name := "the exporter"
+	if client != "" {
+		pusher = pusher.Grouping("client", client)
+		name = client
+	}
+	if err := retry("Pushgateway", p.cfg.RetryConfig, pusher.Push); err != nil {
+		log.Errorf("Cannot push metrics of %s to Pushgateway: %v", name, err)
+	}
+}
+
+// clientFamilies returns the metrics of a client without the client label, which is
+// the grouping key, an empty client returns the metrics without a client label
+func clientFamilies(families []*dto.MetricFamily, client string) []*dto.MetricFamily {
+	var out []*dto.MetricFamily
+	for _, mf := range families {
+		var metrics []*dto.Metric
+		for _, m := range mf.GetMetric() {
+			keep := client == ""
+			labels := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "client" {
+					keep = l.GetValue() == client
+					continue
+				}
+				labels = append(labels, l)
+			}
+			if !keep {
+				continue
+			}
+			metrics = append(metrics, &dto.Metric{
+				Label:       labels,
+				Gauge:       m.Gauge,
+				Counter:     m.Counter,
+				Untyped:     m.Untyped,
+				Summary:     m.Summary,
+				Histogram:   m.Histogram,
+				TimestampMs: m.TimestampMs,
+			})
+		}
+		if len(metrics) > 0 {
+			out = append(out, &dto.MetricFamily{
+				Name:   mf.Name,
+				Help:   mf.Help,
+				Type:   mf.Type,
+				Metric: metrics,
+			})
+		}
+	}
+	return out
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// pushgatewayReceiver records the metric names pushed to every group
+type pushgatewayReceiver struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	groups map[string][]string
+}
+
+func newPushgatewayReceiver(t *testing.T) *pushgatewayReceiver {
+	r := &pushgatewayReceiver{groups: make(map[string][]string)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		dec := expfmt.NewDecoder(req.Body, expfmt.ResponseFormat(req.Header))
+		var names []string
+		for {
+			var mf dto.MetricFamily
+			if err := dec.Decode(&mf); err != nil {
+				break
+			}
+			for _, m := range mf.GetMetric() {
+				for _, l := range m.GetLabel() {
+					if l.GetName() == "client" {
+						t.Errorf("%s pushed with a client label", mf.GetName())
+					}
+				}
+			}
+			names = append(names, mf.GetName())
+		}
+		sort.Strings(names)
+		r.mutex.Lock()
+		r.groups[req.Method+" "+req.URL.Path] = names
+		r.mutex.Unlock()
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func TestPushgatewayGroups(t *testing.T) {
+	set := NewClientSet(true)
+	for _, name := range []string{"push-a", "push-b"} {
+		if err := set.Add(ClientConfig{Name: name, Address: name + ":36330"}); err != nil {
+			t.Fatal(err)
+		}
+		defer set.remove(name)
+	}
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fah_up", Help: "up"}, []string{"client"})
+	up.WithLabelValues("push-a").Set(1)
+	up.WithLabelValues("push-b").Set(0)
+	fleet := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fah_fleet_clients", Help: "clients"})
+	fleet.Set(2)
+	reg.MustRegister(up, fleet)
+
+	receiver := newPushgatewayReceiver(t)
+	p, err := NewPushgateway(PushgatewayConfig{URL: receiver.URL}, reg, set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Push()
+	expected := map[string][]string{
+		"PUT /metrics/job/fah/client/push-a": {"fah_up"},
+		"PUT /metrics/job/fah/client/push-b": {"fah_up"},
+		// Fleet totals are pushed once rather than to every client group
+		"PUT /metrics/job/fah": {"fah_fleet_clients"},
+	}
+	if !reflect.DeepEqual(receiver.groups, expected) {
+		t.Errorf("pushed groups %v, want %v", receiver.groups, expected)
+	}
+}
+
+// remoteWriteReceiver decodes the remote write requests, failing them while fail is set
+type remoteWriteReceiver struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	fail     bool
+	attempts int
+	requests []prompb.WriteRequest
+}
+
+func newRemoteWriteReceiver(t *testing.T) *remoteWriteReceiver {
+	r := &remoteWriteReceiver{}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Content-Encoding") != "snappy" || req.Header.Get("X-Prometheus-Remote-Write-Version") != "0.1.0" {
+			t.Errorf("unexpected headers %v", req.Header)
+		}
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.attempts++
+		if r.fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		compressed, _ := io.ReadAll(req.Body)
+		body, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var wr prompb.WriteRequest
+		if err := wr.Unmarshal(body); err != nil {
+			t.Error(err)
+			return
+		}
+		r.requests = append(r.requests, wr)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *remoteWriteReceiver) setFail(fail bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.fail = fail
+}
+
+// seriesLabels formats the labels of a series in their encoded order
+func seriesLabels(ts prompb.TimeSeries) string {
+	var labels []string
+	for _, l := range ts.Labels {
+		labels = append(labels, l.Name+"="+l.Value)
+	}
+	return strings.Join(labels, ",")
+}
+
+func TestRemoteWriteRequest(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "fah_up", Help: "up"}, []string{"client"})
+	up.WithLabelValues("rw-a").Set(1)
+	dropped := prometheus.NewCounter(prometheus.CounterOpts{Name: "fah_events_dropped_total", Help: "dropped"})
+	dropped.Add(3)
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "other", Help: "not pushed"})
+	reg.MustRegister(up, dropped, other)
+
+	receiver := newRemoteWriteReceiver(t)
+	w, err := NewRemoteWriter(RemoteWriteConfig{
+		URL:            receiver.URL,
+		ExternalLabels: map[string]string{"site": "lab", "client": "external"},
+	}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now().UnixMilli()
+	w.Push()
+	after := time.Now().UnixMilli()
+
+	if len(receiver.requests) != 1 {
+		t.Fatalf("got %d requests", len(receiver.requests))
+	}
+	got := make(map[string]float64)
+	for _, ts := range receiver.requests[0].Timeseries {
+		if len(ts.Samples) != 1 {
+			t.Fatalf("%s has %d samples", seriesLabels(ts), len(ts.Samples))
+		}
+		s := ts.Samples[0]
+		if s.Timestamp < before || s.Timestamp > after {
+			t.Errorf("%s has timestamp %d outside [%d, %d]", seriesLabels(ts), s.Timestamp, before, after)
+		}
+		got[seriesLabels(ts)] = s.Value
+	}
+	// Labels are sorted, external labels are only added to series without them
+	expected := map[string]float64{
+		"__name__=fah_events_dropped_total,client=external,site=lab": 3,
+		"__name__=fah_up,client=rw-a,site=lab":                       1,
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got series %v, want %v", got, expected)
+	}
+}
+
+func TestRemoteWriteBuffer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewGauge(prometheus.GaugeOpts{Name: "fah_up", Help: "up"})
+	reg.MustRegister(up)
+	// Every request has the same size, the buffer holds two
+	size := len(snappy.Encode(nil, encodeWriteRequest(gatherFAH(reg, "test"), time.Now(), nil)))
+
+	receiver := newRemoteWriteReceiver(t)
+	dir := t.TempDir()
+	w, err := NewRemoteWriter(RemoteWriteConfig{
+		URL:            receiver.URL,
+		RetryConfig:    RetryConfig{MaxRetries: 1, RetryBackoff: time.Millisecond},
+		BufferDir:      dir,
+		BufferMaxBytes: int64(size*2 + size/2),
+	}, reg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.setFail(true)
+	for i := 1; i <= 3; i++ {
+		up.Set(float64(i))
+		w.Push()
+		if i == 1 && receiver.attempts != 2 {
+			t.Errorf("sent %d attempts, want the request and one retry", receiver.attempts)
+		}
+	}
+	files, _ := w.bufferFiles()
+	if len(files) != 2 {
+		t.Fatalf("buffered %d requests, want 2", len(files))
+	}
+
+	// The oldest request was dropped, the others are sent in order before the current one
+	receiver.setFail(false)
+	up.Set(4)
+	w.Push()
+	var values []float64
+	for _, req := range receiver.requests {
+		values = append(values, req.Timeseries[0].Samples[0].Value)
+	}
+	if !reflect.DeepEqual(values, []float64{2, 3, 4}) {
+		t.Errorf("sent values %v, want [2 3 4]", values)
+	}
+	if files, _ := w.bufferFiles(); len(files) != 0 {
+		t.Errorf("buffer still has %v", files)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// recorder captures client responses when enabled with -fah.record-dir
+	recorder *Recorder
+
+	redactOptions = regexp.MustCompile(`("(?:user|passkey|password)"\s*:\s*)"[^"]*"`)
+	redactIPv4    = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	// Full IPv6 addresses or compressed ones with ::, times such as 10:28:48 have too few groups
+	redactIPv6 = regexp.MustCompile(`(?i)\b(?:[0-9a-f]{1,4}:){7}[0-9a-f]{1,4}\b|(?:\b[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*)?::(?:[0-9a-f]{1,4}(?::[0-9a-f]{1,4})*\b)?`)
+)
+
+// Recorder writes redacted client responses to capture files, one per client.
+// The capture format can be replayed with fahtest and fah-simulator.
+type Recorder struct {
+	dir   string
+	mutex sync.Mutex
+	files map[string]*os.File
+}
+
+// NewRecorder creates the capture directory
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{dir: dir, files: make(map[string]*os.File)}, nil
+}
+
+// recordingConn is a client connection whose responses are recorded
+type recordingConn struct {
+	net.Conn
+	client string
+}
+
+// recordResponse records a response if the connection is recorded
+func recordResponse(conn net.Conn, command string, name string, payload string, errMsg string) {
+	rc, ok := conn.(*recordingConn)
+	if !ok || recorder == nil {
+		return
+	}
+	// Client names are already redacted by the privacy settings and keep captures apart
+	err := recorder.Record(fahtest.Record{
+		Time:    time.Now(),
+		Client:  rc.client,
+		Command: command,
+		Name:    name,
+		Payload: redact(payload),
+		Error:   redact(errMsg),
+	})
+	if err != nil {
+		log.Errorf("Cannot record response to %s: %v", command, err)
+	}
+}
+
+// redact masks the user, passkey and IP addresses in a payload
+func redact(payload string) string {
+	payload = redactOptions.ReplaceAllString(payload, `$1"REDACTED"`)
+	payload = redactIPv4.ReplaceAllString(payload, "0.0.0.0")
+	return redactIPv6.ReplaceAllString(payload, "::")
+}
+
+// Record appends a record to the capture file of its client
+func (r *Recorder) Record(rec fahtest.Record) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, ok := r.files[rec.Client]
+	if !ok {
+		name := fmt.Sprintf("%s-%s.jsonl", sanitizeFilename(rec.Client), rec.Time.Format("20060102T150405"))
+		var err error
+		f, err = os.OpenFile(filepath.Join(r.dir, name), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		r.files[rec.Client] = f
+	}
+	return json.NewEncoder(f).Encode(rec)
+}
+
+// Close closes all capture files
+func (r *Recorder) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for client, f := range r.files {
+		f.Close()
+		delete(r.files, client)
+	}
+}
+
+var unsafeFilename = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func sanitizeFilename(s string) string {
+	return unsafeFilename.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cosandr/fah-exporter/fahtest"
+)
+
+func TestRedact(t *testing.T) {
+	for _, tc := range []struct {
+		in, out string
+	}{
+		{`{"user": "Alice", "passkey": "0123", "team": "0"}`, `{"user": "REDACTED", "passkey": "REDACTED", "team": "0"}`},
+		{`"ws": "128.252.203.10"`, `"ws": "0.0.0.0"`},
+		{`"ws": "2001:db8:85a3:0:0:8a2e:370:7334"`, `"ws": "::"`},
+		{`"ws": "2001:db8::1"`, `"ws": "::"`},
+		{`"ws": "::1"`, `"ws": "::"`},
+		{`dial tcp [fe80::1]:36330: connection refused`, `dial tcp [::]:36330: connection refused`},
+		// Times and slot descriptions are not addresses
+		{`"assigned": "2020-09-05T10:28:48Z"`, `"assigned": "2020-09-05T10:28:48Z"`},
+		{`"description": "gpu:0:GP102"`, `"description": "gpu:0:GP102"`},
+	} {
+		if got := redact(tc.in); got != tc.out {
+			t.Errorf("redact(%q) = %q, want %q", tc.in, got, tc.out)
+		}
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	dir := t.TempDir()
+	var err error
+	recorder, err = NewRecorder(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { recorder = nil }()
+
+	srv := newTestServer(t)
+	recorded, err := NewClient(ClientConfig{Name: "10.0.0.2:36330", Address: srv.Addr()}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+	recorder = nil
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.jsonl"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("expected one capture file, got %v (%v)", files, err)
+	}
+	records, err := fahtest.ReadCaptureFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range records {
+		// The client name is kept so captures of several clients stay apart
+		if rec.Client != "10.0.0.2:36330" {
+			t.Errorf("record client is %q", rec.Client)
+		}
+	}
+
+	replay, err := fahtest.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replay.Close()
+	replay.Replay(records, 1, false)
+	replayed, err := NewClient(ClientConfig{Name: "replay", Address: replay.Addr()}).Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Options.User != "REDACTED" || replayed.Options.Passkey != "REDACTED" {
+		t.Errorf("user and passkey are not redacted: %+v", replayed.Options)
+	}
+	if replayed.Queues[0].Ws != "0.0.0.0" {
+		t.Errorf("work server address is not redacted: %s", replayed.Queues[0].Ws)
+	}
+	// Everything else replays as recorded
+	replayed.Options.User, replayed.Options.Passkey = recorded.Options.User, recorded.Options.Passkey
+	replayed.Queues[0].Ws, replayed.Queues[0].Cs = recorded.Queues[0].Ws, recorded.Queues[0].Cs
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("replayed data differs\nrecorded: %+v\nreplayed: %+v", recorded, replayed)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Thresholds of the generated alerts
+var (
+	rulesDownFor        time.Duration
+	rulesFailedFor      time.Duration
+	rulesIdleFor        time.Duration
+	rulesStalledFor     time.Duration
+	rulesDeadlineMargin time.Duration
+	rulesMinPPD         float64
+)
+
+func rulesFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&rulesDownFor, "rules.down-for", 5*time.Minute, "Alert when a client is unreachable for this long")
+	fs.DurationVar(&rulesFailedFor, "rules.failed-for", 10*time.Minute, "Alert when a slot is failed for this long")
+	fs.DurationVar(&rulesIdleFor, "rules.idle-for", time.Hour, "Alert when a slot is idle for this long")
+	fs.DurationVar(&rulesStalledFor, "rules.stalled-for", time.Hour, "Alert when a running unit makes no progress for this long")
+	fs.DurationVar(&rulesDeadlineMargin, "rules.deadline-margin", time.Hour, "Alert when a unit is projected to finish less than this before its timeout")
+	fs.Float64Var(&rulesMinPPD, "rules.min-ppd", 0, "Alert when the PPD of a client is below this, 0 to disable")
+}
+
+// ruleFile is a Prometheus rule file
+type ruleFile struct {
+	Groups []ruleGroup `yaml:"groups" json:"groups"`
+}
+
+type ruleGroup struct {
+	Name  string `yaml:"name" json:"name"`
+	Rules []rule `yaml:"rules" json:"rules"`
+}
+
+type rule struct {
+	Record      string            `yaml:"record,omitempty" json:"record,omitempty"`
+	Alert       string            `yaml:"alert,omitempty" json:"alert,omitempty"`
+	Expr        string            `yaml:"expr" json:"expr"`
+	For         string            `yaml:"for,omitempty" json:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty" json:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty" json:"annotations,omitempty"`
+}
+
+// promDuration formats a duration the way Prometheus parses it, such as 1h30m
+func promDuration(d time.Duration) string {
+	return model.Duration(d).String()
+}
+
+func alert(name string, expr string, d time.Duration, severity string, summary string) rule {
+	r := rule{
+		Alert:       name,
+		Expr:        expr,
+		Labels:      map[string]string{"severity": severity},
+		Annotations: map[string]string{"summary": summary},
+	}
+	if d > 0 {
+		r.For = promDuration(d)
+	}
+	return r
+}
+
+// generateRules returns recording and alerting rules for the metrics exported by this version,
+// series are identified by their target labels and the client label of multi-client setups
+func generateRules() ruleFile {
+	alerts := []rule{
+		alert("FAHClientDown", "fah_up == 0", rulesDownFor, "critical",
+			"FAH client {{ $labels.instance }} {{ $labels.client }} is unreachable"),
+		alert("FAHSlotFailed", `fah_slot_status{status="FAILED"} == 1`, rulesFailedFor, "critical",
+			"Slot {{ $labels.slot }} of {{ $labels.instance }} {{ $labels.client }} failed"),
+		alert("FAHSlotIdle", "fah_idle == 1", rulesIdleFor, "warning",
+			"Slot {{ $labels.slot }} of {{ $labels.instance }} {{ $labels.client }} is idle"),
+		alert("FAHUnitStalled",
+			fmt.Sprintf(`changes(fah_percent_done[%s]) == 0 and ignoring(state) fah_queue_state{state="RUNNING"} == 1`, promDuration(rulesStalledFor)),
+			0, "warning",
+			"Unit {{ $labels.queue }} on slot {{ $labels.slot }} of {{ $labels.instance }} {{ $labels.client }} made no progress"),
+		alert("FAHUnitDeadlineRisk",
+			fmt.Sprintf("fah_unit_deadline_margin_seconds < %g", rulesDeadlineMargin.Seconds()),
+			15*time.Minute, "warning",
+			"Unit {{ $labels.queue }} on slot {{ $labels.slot }} of {{ $labels.instance }} {{ $labels.client }} may miss its timeout"),
+	}
+	if rulesMinPPD > 0 {
+		alerts = append(alerts, alert("FAHLowPPD",
+			fmt.Sprintf("instance:fah_ppd:sum < %g and fah_up == 1", rulesMinPPD),
+			30*time.Minute, "warning",
+			"{{ $labels.instance }} {{ $labels.client }} produces {{ $value }} PPD"))
+	}
+	return ruleFile{Groups: []ruleGroup{
+		{
+			Name: "fah.rules",
+			Rules: []rule{
+				{Record: "instance:fah_ppd:sum", Expr: "sum without (slot, queue) (fah_ppd)"},
+				{Record: "job:fah_ppd:sum", Expr: "sum by (job) (fah_ppd)"},
+				{Record: "instance:fah_slots_running:sum", Expr: `sum without (slot, status) (fah_slot_status{status="RUNNING"})`},
+			},
+		},
+		{Name: "fah.alerts", Rules: alerts},
+	}}
+}
+
+// renderRules encodes the rule file as YAML, or as JSON for the json output which
+// Prometheus loads as well
+func renderRules(output string) ([]byte, error) {
+	if output == "json" {
+		return json.MarshalIndent(generateRules(), "", "  ")
+	}
+	// Keep expressions on one line
+	yaml.FutureLineWrap()
+	return yaml.Marshal(generateRules())
+}
+
+// runRules prints the rule file
+func runRules(output string) int {
+	b, err := renderRules(output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot generate rules: %v\n", err)
+		return exitUnknown
+	}
+	os.Stdout.Write(b)
+	return exitOK
+}
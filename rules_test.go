@@ -0,0 +1,33 @@
+package main
+
+import (
+	"flag"
+	"testing"
+
+	"github.com/prometheus/prometheus/model/rulefmt"
+)
+
+func TestRulesParse(t *testing.T) {
+	// Register the flags for their defaults
+	rulesFlags(flag.NewFlagSet("rules", flag.ContinueOnError))
+	for _, minPPD := range []float64{0, 500000} {
+		rulesMinPPD = minPPD
+		for _, output := range []string{"table", "json"} {
+			b, err := renderRules(output)
+			if err != nil {
+				t.Fatal(err)
+			}
+			groups, errs := rulefmt.Parse(b)
+			for _, err := range errs {
+				t.Errorf("min PPD %g, %s output: %v", minPPD, output, err)
+			}
+			if len(errs) > 0 {
+				continue
+			}
+			if len(groups.Groups) != 2 || len(groups.Groups[1].Rules) == 0 {
+				t.Errorf("min PPD %g, %s output: unexpected groups %+v", minPPD, output, groups.Groups)
+			}
+		}
+	}
+	rulesMinPPD = 0
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+//go:embed web
+var webFS embed.FS
+
+var statusTemplate = template.Must(template.ParseFS(webFS, "web/templates/status.html"))
+
+// statusPage is the data of the status page template
+type statusPage struct {
+	Refresh     int
+	MetricsPath string
+	Clients     []clientView
+}
+
+type clientView struct {
+	Name    string
+	Address string
+	Up      bool
+	Error   string
+	Updated time.Time
+	User    string
+	Team    string
+	Power   string
+	Slots   []slotView
+}
+
+type slotView struct {
+	ID          string
+	Description string
+	Status      string
+	Reason      string
+	Units       []unitView
+}
+
+type unitView struct {
+	Queue   string
+	State   string
+	Project string
+	Percent float64
+	PPD     float64
+	ETA     string
+	Error   string
+}
+
+func newClientView(c *Client, s Snapshot) clientView {
+	v := clientView{
+		Name:    c.Name,
+		Address: privacy.Apply(fieldAddress, c.Address),
+		Up:      s.Error == nil,
+		Updated: s.Time,
+		User:    s.Data.Options.User,
+		Team:    s.Data.Options.Team,
+		Power:   s.Data.Options.Power,
+	}
+	if s.Error != nil {
+		v.Error = privacy.Scrub(s.Error.Error())
+		return v
+	}
+	for _, slot := range s.Data.Slots {
+		sv := slotView{
+			ID:          slot.ID,
+			Description: slot.Description,
+			Status:      slot.Status,
+			Reason:      slot.Reason,
+		}
+		for _, q := range s.Data.Queues {
+			if q.Slot != slot.ID {
+				continue
+			}
+			percent, _ := strconv.ParseFloat(strings.TrimSuffix(q.PercentDone, "%"), 64)
+			ppd, _ := strconv.ParseFloat(q.Ppd, 64)
+			sv.Units = append(sv.Units, unitView{
+				Queue:   q.ID,
+				State:   q.State,
+				Project: fmt.Sprintf("%d (%d, %d, %d)", q.Project, q.Run, q.Clone, q.Gen),
+				Percent: percent,
+				PPD:     ppd,
+				ETA:     q.Eta,
+				Error:   q.Error,
+			})
+		}
+		v.Slots = append(v.Slots, sv)
+	}
+	return v
+}
+
+// statusHandler serves the status page, clients are only queried when their data is older than refresh
+func statusHandler(set *ClientSet, metricsPath string, refresh time.Duration) http.Handler {
+	static, err := fs.Sub(webFS, "web/static")
+	if err != nil {
+		log.Panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.FS(static))))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		page := statusPage{
+			Refresh:     int(refresh.Seconds()),
+			MetricsPath: metricsPath,
+		}
+		for _, c := range set.All() {
+			page.Clients = append(page.Clients, newClientView(c, c.Snapshot(refresh)))
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, page); err != nil {
+			log.Errorf("Cannot render status page: %v", err)
+		}
+	})
+	return mux
+}
+
+// metricsHandler serves the metrics of every client, or of a single client with the target
+// parameter, as set by the discovery targets
+func metricsHandler(set *ClientSet) http.Handler {
+	all := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			all.ServeHTTP(w, r)
+			return
+		}
+		gatherer := set.Gatherer(target)
+		if gatherer == nil {
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+			return
+		}
+		promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}